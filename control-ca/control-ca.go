@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+)
+
+// A tiny certificate authority for the links between the daemons
+// Every daemon gets a certificate naming its role, and only trusts certificates from this CA with the role it expects
+// on the other end
+
+// The roles we issue certificates for, these double as the names the daemons verify
+var roles = map[string]bool{
+	"webserver-frontend": true,
+	"hypervisor-daemon":  true,
+	"torcontrol-daemon":  true,
+	// Only for scraping hypervisor-daemon's metrics
+	"prometheus": true,
+}
+
+// Everything is written here, relative to where we run
+const caDir = "ca/"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "init":
+		err = initCA()
+	case "issue":
+		if len(os.Args) != 3 {
+			usage()
+			os.Exit(1)
+		}
+		err = issue(os.Args[2])
+	default:
+		usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Printf("Failed: %v\r\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  control-ca init           create a new CA in ca/")
+	fmt.Println("  control-ca issue <role>   issue a certificate for webserver-frontend, hypervisor-daemon, torcontrol-daemon or prometheus")
+}
+
+func initCA() error {
+	// Never overwrite an existing CA, every certificate it issued would stop working
+	_, err := os.Stat(caDir + "ca.key")
+	if err == nil {
+		return errors.New("a CA already exists in " + caDir)
+	}
+
+	err = os.MkdirAll(caDir, 0700) // readable only by *us*
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "torhost-control CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	err = writeKeyPair(caDir+"ca", der, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("CA created in " + caDir + ", keep ca.key somewhere safe")
+	return nil
+}
+
+func issue(role string) error {
+	if !roles[role] {
+		return errors.New("unknown role " + role)
+	}
+
+	caCert, caKey, err := loadCA()
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	// The role goes in both the CN and a DNS name, so clients can verify it like a hostname
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: role},
+		DNSNames:     []string{role},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Every daemon is both a client and a server to another
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	err = writeKeyPair(caDir+role, der, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Issued %v%v.crt, valid until %v\r\n", caDir, role, template.NotAfter.Format("2006-01-02"))
+	fmt.Printf("Copy %vca.crt, %v%v.crt and %v%v.key to the config/ directory of %v\r\n", caDir, caDir, role, caDir, role, role)
+	return nil
+}
+
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPem, err := ioutil.ReadFile(caDir + "ca.crt")
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := ioutil.ReadFile(caDir + "ca.key")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, nil, errors.New("invalid ca.crt")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ = pem.Decode(keyPem)
+	if block == nil {
+		return nil, nil, errors.New("invalid ca.key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// Write out name.crt and name.key
+func writeKeyPair(name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// When the host reboots, the bridges come back by themselves through rc-update, but the guests don't
+// Anything the registry says should be running is started again with the arguments it last ran with, unless its owner
+// or an admin turned autostart off. ShouldRun stays set while we restore them, so if the host goes down again part way
+// through, the ones we hadn't got to yet are still restored next time
+
+// Guests are started one at a time this far apart, so a reboot doesn't have every guest booting at once and fighting
+// over the disk
+const autostartInterval = 15 * time.Second
+
+// Whether a guest in this state was meant to be running, for records from before ShouldRun
+func wasUp(status string) bool {
+	switch status {
+	case "", "stopped", "broken", "creating", "deleting", "suspended":
+		return false
+	}
+	return true
+}
+
+// Start the given guests again, slowly
+func (v *VMList) restoreGuests(vmIds []int) {
+	sort.Ints(vmIds)
+	for i, vmId := range vmIds {
+		if i > 0 {
+			time.Sleep(autostartInterval)
+		}
+
+		// Someone may have got to it while we waited
+		v.mux.Lock()
+		vminfo, exists := v.Vms[vmId]
+		v.mux.Unlock()
+		if !exists || !vminfo.Autostart || !vminfo.ShouldRun || vminfo.Status != "stopped" {
+			continue
+		}
+
+		fmt.Println(fmt.Sprintf("[%v] Restoring vm%v", time.Now(), vmId))
+		err := backend.Restore(vmId)
+		if err != nil {
+			// Leave it stopped, someone has to look at it
+			fmt.Fprintf(os.Stderr, "error restoring vm%v: %v\n", vmId, err)
+			continue
+		}
+	}
+
+	if len(vmIds) > 0 {
+		fmt.Println(fmt.Sprintf("[%v] Finished restoring %v VMs", time.Now(), len(vmIds)))
+	}
+}
+
+// Record whether a guest is meant to be running, when it's started or stopped on purpose
+func (v *VMList) setShouldRun(vmId int, shouldRun bool) {
+	v.mux.Lock()
+	vminfo, exists := v.Vms[vmId]
+	if !exists || vminfo.ShouldRun == shouldRun {
+		v.mux.Unlock()
+		return
+	}
+	vminfo.ShouldRun = shouldRun
+	v.Vms[vmId] = vminfo
+	v.mux.Unlock()
+
+	err := saveVM(vminfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", vmId, err)
+	}
+}
+
+func (v *VMList) setAutostart(vmId int, enabled bool) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	vminfo, exists := v.Vms[vmId]
+	if !exists {
+		return fmt.Errorf("no vm%v", vmId)
+	}
+	vminfo.Autostart = enabled
+	v.Vms[vmId] = vminfo
+
+	return saveVM(vminfo)
+}
+
+// Whether a guest is started again after a reboot
+// GET /vm/N/autostart says on or off, POST /vm/N/autostart?enabled=on or off changes it
+func autostartHandler(w http.ResponseWriter, r *http.Request, vmId int, v *VMList) {
+	if r.Method == "GET" {
+		v.mux.Lock()
+		enabled := v.Vms[vmId].Autostart
+		v.mux.Unlock()
+		if enabled {
+			fmt.Fprintf(w, "on")
+		} else {
+			fmt.Fprintf(w, "off")
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The setting comes in the query string, so it is covered by the request signature
+	var enabled bool
+	switch r.URL.Query().Get("enabled") {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+
+	err := v.setAutostart(vmId, enabled)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting autostart of vm%v: %v\n", vmId, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "ok")
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A backend that only pretends, for running the daemon somewhere without root, qemu or OpenRC
+// It keeps just enough state to refuse the same things the real one would, e.g. starting a VM with no disk
+
+type fakeGuest struct {
+	Disk    bool
+	Network bool
+	// Whether it has ever been started, the supervisor doesn't know about guests before that
+	Started   bool
+	Running   bool
+	Status    string
+	ExitCode  int
+	Suspended bool
+	Snapshots []Snapshot
+}
+
+type fakeBackend struct {
+	mux    sync.Mutex
+	guests map[int]*fakeGuest
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{guests: make(map[int]*fakeGuest)}
+}
+
+// The guest, created if it's new, the caller must hold the lock
+func (f *fakeBackend) guest(vmId int) *fakeGuest {
+	g, exists := f.guests[vmId]
+	if !exists {
+		g = &fakeGuest{}
+		f.guests[vmId] = g
+	}
+	return g
+}
+
+func (f *fakeBackend) ProvisionDisk(vmId int, plan Plan, img Image) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g := f.guest(vmId)
+	if g.Disk {
+		return errors.New("creating disk image directory: already exists")
+	}
+	g.Disk = true
+	return nil
+}
+
+func (f *fakeBackend) AttachNetwork(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g := f.guest(vmId)
+	if g.Network {
+		return errors.New("creating bridge symlink: already exists")
+	}
+	g.Network = true
+	return nil
+}
+
+func (f *fakeBackend) Start(vmId int, plan Plan, img Image) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Disk || !g.Network {
+		return errors.New("starting qemu: no disk or network")
+	}
+	if g.Running {
+		return errors.New("starting qemu: already running")
+	}
+	g.Started = true
+	g.Running = true
+	g.Status = "running"
+	g.ExitCode = 0
+	g.Suspended = false
+	return nil
+}
+
+func (f *fakeBackend) Restore(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Started {
+		return errNoArgs
+	}
+	if g.Running {
+		return errors.New("starting qemu: already running")
+	}
+	g.Running = true
+	g.Status = "running"
+	g.ExitCode = 0
+	g.Suspended = false
+	return nil
+}
+
+func (f *fakeBackend) Stop(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Running {
+		return errors.New("stopping qemu: not running")
+	}
+	g.Running = false
+	g.Status = ""
+	return nil
+}
+
+func (f *fakeBackend) Power(vmId int, action string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Running {
+		return errors.New("not running")
+	}
+
+	switch action {
+	case "powerdown":
+		// The guest shuts itself down cleanly, like qemu exiting with 0
+		g.Running = false
+		g.Status = ""
+		g.ExitCode = 0
+		if guestStopped != nil {
+			go guestStopped(vmId)
+		}
+	case "reset", "cont":
+		g.Status = "running"
+	case "stop":
+		g.Status = "paused"
+	default:
+		return fmt.Errorf("unknown power action %q", action)
+	}
+	return nil
+}
+
+func (f *fakeBackend) Suspend(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Running {
+		return errors.New("not running")
+	}
+	g.Running = false
+	g.Status = ""
+	g.ExitCode = 0
+	g.Suspended = true
+	return nil
+}
+
+func (f *fakeBackend) Resume(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Suspended {
+		return errors.New("not suspended")
+	}
+	if g.Running {
+		return errors.New("starting qemu: already running")
+	}
+	g.Running = true
+	g.Status = "running"
+	g.Suspended = false
+	return nil
+}
+
+func (f *fakeBackend) Resources(vmId int) (GuestResources, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists {
+		return GuestResources{}, nil
+	}
+	return GuestResources{Disk: g.Disk, Network: NetworkState{Recorded: g.Network, Vlan: g.Network, Bridge: g.Network}}, nil
+}
+
+func (f *fakeBackend) DetachNetwork(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists {
+		return nil
+	}
+	if g.Running {
+		return errors.New("still running")
+	}
+	g.Network = false
+	f.forget(vmId)
+	return nil
+}
+
+func (f *fakeBackend) RemoveDisk(vmId int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists {
+		return nil
+	}
+	if g.Running {
+		return errors.New("still running")
+	}
+	g.Disk = false
+	f.forget(vmId)
+	return nil
+}
+
+// Drop a guest once nothing of it is left, the caller must hold the lock
+func (f *fakeBackend) forget(vmId int) {
+	if g := f.guests[vmId]; !g.Disk && !g.Network {
+		delete(f.guests, vmId)
+	}
+}
+
+func (f *fakeBackend) ListSnapshots(vmId int) ([]Snapshot, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Disk {
+		return nil, errors.New("no disk")
+	}
+	return append([]Snapshot{}, g.Snapshots...), nil
+}
+
+func (f *fakeBackend) CreateSnapshot(vmId int, name string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Disk {
+		return errors.New("no disk")
+	}
+	if f.snapshot(g, name) >= 0 {
+		return errors.New("snapshot already exists")
+	}
+	g.Snapshots = append(g.Snapshots, Snapshot{Name: name, Created: time.Now()})
+	return nil
+}
+
+func (f *fakeBackend) RevertSnapshot(vmId int, name string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || f.snapshot(g, name) < 0 {
+		return errors.New("no such snapshot")
+	}
+	if g.Suspended {
+		return errors.New("suspended, resume it first")
+	}
+	// There's no disk to put back, a running guest just carries on
+	return nil
+}
+
+func (f *fakeBackend) DeleteSnapshot(vmId int, name string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists {
+		return errors.New("no such snapshot")
+	}
+	i := f.snapshot(g, name)
+	if i < 0 {
+		return errors.New("no such snapshot")
+	}
+	g.Snapshots = append(g.Snapshots[:i], g.Snapshots[i+1:]...)
+	return nil
+}
+
+// Where the named snapshot is in the guest's list, or -1, the caller must hold the lock
+func (f *fakeBackend) snapshot(g *fakeGuest, name string) int {
+	for i, s := range g.Snapshots {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Made up, but enough to see a guest in /metrics
+func (f *fakeBackend) Usage(vmId int) (GuestUsage, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Disk {
+		return GuestUsage{}, errors.New("no such guest")
+	}
+	u := GuestUsage{Running: g.Running, DiskAllocatedBytes: 200 << 20, DiskSizeBytes: 10 << 30}
+	if g.Running {
+		u.RSSBytes = 512 << 20
+	}
+	return u, nil
+}
+
+func (f *fakeBackend) ConsoleLog(vmId int, size int) ([]byte, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Started {
+		return nil, errors.New("no such guest")
+	}
+	out := []byte(fmt.Sprintf("vm%v is a fake guest, it has nothing to say\n", vmId))
+	if len(out) > size {
+		out = out[len(out)-size:]
+	}
+	return out, nil
+}
+
+func (f *fakeBackend) AttachConsole(vmId int) (io.ReadWriteCloser, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Running {
+		return nil, errors.New("console not connected")
+	}
+	// A fake guest just echoes whatever is typed at it
+	r, w := io.Pipe()
+	return struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{r, w, w}, nil
+}
+
+func (f *fakeBackend) Inspect(vmId int) (GuestState, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	g, exists := f.guests[vmId]
+	if !exists || !g.Started {
+		return GuestState{}, errors.New("no such guest")
+	}
+	return GuestState{Running: g.Running, Status: g.Status, ExitCode: g.ExitCode, Suspended: g.Suspended}, nil
+}
+
+func (f *fakeBackend) List() map[int]GuestState {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	guests := make(map[int]GuestState)
+	for id, g := range f.guests {
+		if !g.Started {
+			continue
+		}
+		guests[id] = GuestState{Running: g.Running, Status: g.Status, ExitCode: g.ExitCode, Suspended: g.Suspended}
+	}
+	return guests
+}
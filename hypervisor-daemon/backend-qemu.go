@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// The real backend, qemu guests under our supervisor on OpenRC managed bridges
+type qemuBackend struct{}
+
+func (q *qemuBackend) ProvisionDisk(vmId int, plan Plan, img Image) error {
+	// Don't build anything on an image that isn't what we think it is
+	err := img.verify()
+	if err != nil {
+		return fmt.Errorf("verifying image %v: %v", img.Id, err)
+	}
+
+	// Create a new directory for the VM disk image
+	err = os.Mkdir(vmDir(vmId), 0755)
+	if err != nil {
+		return fmt.Errorf("creating disk image directory: %v", err)
+	}
+
+	// Create new disk image, at the size of the plan rather than whatever size the base image happens to be
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-o", "backing_file="+img.backingPath(), img.diskPath(vmId), fmt.Sprintf("%vG", plan.DiskSize)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("creating disk image: %v %s", err, out)
+	}
+
+	return nil
+}
+
+func (q *qemuBackend) AttachNetwork(vmId int) error {
+	// Create our network bridge and configuration, see network.go
+	return network.Attach(vmId)
+}
+
+func (q *qemuBackend) Start(vmId int, plan Plan, img Image) error {
+	// The supervisor keeps it running from here on
+	// There's no terminal any more, so the serial console goes to a socket we log, and the monitor nowhere, as we have QMP
+	args := []string{"-nographic", "-enable-kvm", "-cpu", "host", "-m", fmt.Sprintf("%vM", plan.Memory), "-smp", fmt.Sprintf("%v", plan.VCPUs), "-drive", fmt.Sprintf("file=%v,if=virtio", img.diskPath(vmId)), "-netdev", fmt.Sprintf("tap,helper=/usr/libexec/qemu-bridge-helper --br=br%v,id=hn0", vmId), "-device", "virtio-net-pci,netdev=hn0,id=nic1", "-append", fmt.Sprintf("root=%v ro vmid=%v", img.RootDevice, vmId), "-kernel", img.kernelPath(), "-qmp", fmt.Sprintf("unix:%v,server,nowait", qmpSocket(vmId)), "-serial", fmt.Sprintf("unix:%v,server,nowait", consoleSocket(vmId)), "-monitor", "none"}
+	if img.Initrd != "" {
+		args = append(args, "-initrd", img.initrdPath())
+	}
+	// Booting afresh makes any saved memory stale
+	err := discardState(vmId)
+	if err != nil {
+		return err
+	}
+	err = supervisor.start(vmId, args)
+	if err != nil {
+		return fmt.Errorf("starting qemu: %v", err)
+	}
+
+	return nil
+}
+
+func (q *qemuBackend) Restore(vmId int) error {
+	// The supervisor kept the arguments next to the disk when it first started it
+	buf, err := ioutil.ReadFile(vmDir(vmId) + "/qemu.args")
+	if os.IsNotExist(err) {
+		return errNoArgs
+	}
+	if err != nil {
+		return fmt.Errorf("reading qemu arguments: %v", err)
+	}
+	var args []string
+	err = json.Unmarshal(buf, &args)
+	if err != nil {
+		return fmt.Errorf("reading qemu arguments: %v", err)
+	}
+	// Guests we adopted without their arguments saved them as null
+	if len(args) == 0 {
+		return errNoArgs
+	}
+
+	err = discardState(vmId)
+	if err != nil {
+		return err
+	}
+	err = supervisor.start(vmId, args)
+	if err != nil {
+		return fmt.Errorf("starting qemu: %v", err)
+	}
+
+	return nil
+}
+
+func (q *qemuBackend) Stop(vmId int) error {
+	// Make sure it isn't restarted behind our back
+	err := supervisor.stop(vmId)
+	if err != nil {
+		return fmt.Errorf("stopping qemu: %v", err)
+	}
+
+	return nil
+}
+
+func (q *qemuBackend) Power(vmId int, action string) error {
+	// The QMP command for each action
+	commands := map[string]string{
+		"powerdown": "system_powerdown",
+		"reset":     "system_reset",
+		"stop":      "stop",
+		"cont":      "cont",
+	}
+	command, ok := commands[action]
+	if !ok {
+		return fmt.Errorf("unknown power action %q", action)
+	}
+
+	_, err := qmpCommand(vmId, command, nil)
+	return err
+}
+
+func (q *qemuBackend) Suspend(vmId int) error {
+	if g, exists := supervisor.status(vmId); !exists || !g.Running {
+		return errors.New("not running")
+	}
+
+	// Pause it first, so nothing changes between saving its memory and stopping it
+	_, err := qmpCommand(vmId, "stop", nil)
+	if err != nil {
+		return fmt.Errorf("pausing guest: %v", err)
+	}
+
+	// Save to a temporary file, so a half written one is never taken for the real thing
+	partial := stateFile(vmId) + ".partial"
+	err = migrate(vmId, "exec:cat > "+partial)
+	if err != nil {
+		// Leave it how we found it
+		os.Remove(partial)
+		_, contErr := qmpCommand(vmId, "cont", nil)
+		if contErr != nil {
+			fmt.Fprintf(os.Stderr, "error unpausing vm%v after failing to suspend it: %v\n", vmId, contErr)
+		}
+		return fmt.Errorf("saving memory: %v", err)
+	}
+
+	err = supervisor.stop(vmId)
+	if err != nil {
+		return fmt.Errorf("stopping qemu: %v", err)
+	}
+	err = os.Rename(partial, stateFile(vmId))
+	if err != nil {
+		return fmt.Errorf("saving memory: %v", err)
+	}
+	return nil
+}
+
+func (q *qemuBackend) Resume(vmId int) error {
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		return errors.New("already running")
+	}
+	_, err := os.Stat(stateFile(vmId))
+	if err != nil {
+		return fmt.Errorf("not suspended: %v", err)
+	}
+
+	// It has to come back with exactly what it was suspended with, or the memory won't fit
+	buf, err := ioutil.ReadFile(vmDir(vmId) + "/qemu.args")
+	if err != nil {
+		return fmt.Errorf("reading qemu arguments: %v", err)
+	}
+	var args []string
+	err = json.Unmarshal(buf, &args)
+	if err != nil {
+		return fmt.Errorf("reading qemu arguments: %v", err)
+	}
+
+	err = supervisor.startIncoming(vmId, args, "exec:cat "+stateFile(vmId))
+	if err != nil {
+		return fmt.Errorf("starting qemu: %v", err)
+	}
+
+	// qemu carries on by itself once it has loaded the memory, only then is the saved copy spent
+	err = waitForIncoming(vmId)
+	if err != nil {
+		supervisor.stop(vmId)
+		return fmt.Errorf("loading memory: %v", err)
+	}
+	return discardState(vmId)
+}
+
+func (q *qemuBackend) Resources(vmId int) (GuestResources, error) {
+	var r GuestResources
+
+	_, err := diskFile(vmId)
+	r.Disk = err == nil
+
+	r.Network, err = network.Inspect(vmId)
+	if err != nil {
+		return r, fmt.Errorf("inspecting network: %v", err)
+	}
+	return r, nil
+}
+
+func (q *qemuBackend) DetachNetwork(vmId int) error {
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		return errors.New("still running")
+	}
+	return network.Detach(vmId)
+}
+
+func (q *qemuBackend) RemoveDisk(vmId int) error {
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		return errors.New("still running")
+	}
+	// Its arguments and pidfile go with the directory, so there's nothing left to restart
+	supervisor.forget(vmId)
+
+	err := os.RemoveAll(vmDir(vmId))
+	if err != nil {
+		return fmt.Errorf("removing disk image: %v", err)
+	}
+	return nil
+}
+
+func (q *qemuBackend) Usage(vmId int) (GuestUsage, error) {
+	var u GuestUsage
+
+	g, exists := supervisor.status(vmId)
+	if exists && g.Running {
+		cpu, rss, err := processUsage(g.Pid)
+		if err != nil {
+			return u, fmt.Errorf("reading usage of pid %v: %v", g.Pid, err)
+		}
+		u.Running = true
+		u.CPUSeconds = cpu
+		u.RSSBytes = rss
+	}
+
+	disk, err := diskFile(vmId)
+	if err != nil {
+		return u, err
+	}
+	u.DiskAllocatedBytes, err = allocatedSize(disk)
+	if err != nil {
+		return u, err
+	}
+	u.DiskSizeBytes, err = qcow2Size(disk)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+func (q *qemuBackend) ConsoleLog(vmId int, size int) ([]byte, error) {
+	return consoleTail(vmId, int64(size))
+}
+
+func (q *qemuBackend) AttachConsole(vmId int) (io.ReadWriteCloser, error) {
+	session, err := attachConsole(vmId)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (q *qemuBackend) Inspect(vmId int) (GuestState, error) {
+	g, exists := supervisor.status(vmId)
+	if !exists {
+		return GuestState{}, errors.New("no such guest")
+	}
+	return q.state(g), nil
+}
+
+func (q *qemuBackend) List() map[int]GuestState {
+	guests := make(map[int]GuestState)
+	for id, g := range supervisor.list() {
+		guests[id] = q.state(g)
+	}
+	return guests
+}
+
+// Ask qemu what the guest is really doing, rather than guessing from whether the process exists
+func (q *qemuBackend) state(g guestProcess) GuestState {
+	if !g.Running {
+		_, err := os.Stat(stateFile(g.VmId))
+		return GuestState{ExitCode: g.ExitCode, Suspended: err == nil}
+	}
+
+	status, err := queryStatus(g.VmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error querying status of vm%v: %v\n", g.VmId, err)
+		status = "unknown"
+	}
+	return GuestState{Running: true, Status: status}
+}
+
+func (q *qemuBackend) ListSnapshots(vmId int) ([]Snapshot, error) {
+	var info qemuSnapshots
+
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		// qemu holds a lock on the disk while it runs, so ask it rather than qemu-img
+		ret, err := qmpCommand(vmId, "query-block", nil)
+		if err != nil {
+			return nil, err
+		}
+		var devices []struct {
+			Device   string `json:"device"`
+			Inserted *struct {
+				Image qemuSnapshots `json:"image"`
+			} `json:"inserted"`
+		}
+		err = json.Unmarshal(ret, &devices)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range devices {
+			if d.Device == diskDevice && d.Inserted != nil {
+				return d.Inserted.Image.list(), nil
+			}
+		}
+		return nil, fmt.Errorf("no %v in query-block", diskDevice)
+	}
+
+	disk, err := diskFile(vmId)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("qemu-img", "info", "--output=json", disk).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info: %v", err)
+	}
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		return nil, err
+	}
+	return info.list(), nil
+}
+
+func (q *qemuBackend) CreateSnapshot(vmId int, name string) error {
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		// This is only as consistent as pulling the plug would be, but a journalling filesystem copes with that
+		_, err := qmpCommand(vmId, "blockdev-snapshot-internal-sync", map[string]string{"device": diskDevice, "name": name})
+		return err
+	}
+	return q.qemuImgSnapshot(vmId, "-c", name)
+}
+
+func (q *qemuBackend) RevertSnapshot(vmId int, name string) error {
+	// Saved memory only makes sense with the disk it was saved with
+	_, err := os.Stat(stateFile(vmId))
+	if err == nil {
+		return errors.New("suspended, resume it first")
+	}
+
+	// There's no reverting a disk under a running guest, so stop it and start it again afterwards the same way
+	g, exists := supervisor.status(vmId)
+	wasRunning := exists && g.Running
+	if wasRunning {
+		err := supervisor.stop(vmId)
+		if err != nil {
+			return fmt.Errorf("stopping qemu: %v", err)
+		}
+	}
+
+	err = q.qemuImgSnapshot(vmId, "-a", name)
+	if err != nil {
+		return err
+	}
+
+	if wasRunning {
+		err = supervisor.start(vmId, g.Args)
+		if err != nil {
+			return fmt.Errorf("starting qemu: %v", err)
+		}
+	}
+	return nil
+}
+
+func (q *qemuBackend) DeleteSnapshot(vmId int, name string) error {
+	if g, exists := supervisor.status(vmId); exists && g.Running {
+		_, err := qmpCommand(vmId, "blockdev-snapshot-delete-internal-sync", map[string]string{"device": diskDevice, "name": name})
+		return err
+	}
+	return q.qemuImgSnapshot(vmId, "-d", name)
+}
+
+// Run qemu-img snapshot on a VM's disk, which must not be in use
+func (q *qemuBackend) qemuImgSnapshot(vmId int, flag string, name string) error {
+	disk, err := diskFile(vmId)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("qemu-img", "snapshot", flag, name, disk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img snapshot %v: %v %s", flag, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Everything that actually touches the machine when creating, running and deleting a VM goes through a backend
+// The real one drives qemu, qemu-img, OpenRC and ip, the fake one only keeps state in memory so the daemon can be run
+// and poked at without root or any VMs
+
+type VMBackend interface {
+	// Create the VM's disk on top of the image, sized for its plan
+	ProvisionDisk(vmId int, plan Plan, img Image) error
+	// Set up the VM's vlan and bridge, leaving nothing behind if it fails
+	AttachNetwork(vmId int) error
+	// Boot the VM with the resources of its plan and the image's kernel, and keep it running
+	Start(vmId int, plan Plan, img Image) error
+	// Start the VM again with exactly what it last ran with, after the host has rebooted, errNoArgs if it never ran
+	Restore(vmId int) error
+	// Stop the VM, it has to be started again to come back
+	Stop(vmId int) error
+	// A power action from the owner, one of powerdown, reset, stop or cont
+	Power(vmId int, action string) error
+	// Save the VM's memory next to its disk and stop it, so it stops using the host's RAM until it's resumed
+	Suspend(vmId int) error
+	// Start a suspended VM again from its saved memory, right where it left off
+	Resume(vmId int) error
+	// Which of the things ProvisionDisk and AttachNetwork make actually exist, for repairing a broken VM
+	Resources(vmId int) (GuestResources, error)
+	// Undo AttachNetwork, the VM must already be stopped, and anything already gone is skipped
+	DetachNetwork(vmId int) error
+	// Undo ProvisionDisk, removing everything else we keep for the VM with it, the same goes for this
+	RemoveDisk(vmId int) error
+	// Snapshots of the VM's disk, which may be running or not
+	ListSnapshots(vmId int) ([]Snapshot, error)
+	CreateSnapshot(vmId int, name string) error
+	// Put the disk back how it was, a running VM is restarted to pick it up
+	RevertSnapshot(vmId int, name string) error
+	DeleteSnapshot(vmId int, name string) error
+	// The last size bytes of the VM's serial console
+	ConsoleLog(vmId int, size int) ([]byte, error)
+	// An interactive session on the VM's serial console, errConsoleBusy if someone else has one
+	AttachConsole(vmId int) (io.ReadWriteCloser, error)
+	// What a single VM is doing
+	Inspect(vmId int) (GuestState, error)
+	// What every VM the backend knows about is doing
+	List() map[int]GuestState
+	// The resources a VM is using, for /metrics
+	Usage(vmId int) (GuestUsage, error)
+}
+
+// What a backend can tell us about a guest
+type GuestState struct {
+	Running bool
+	// As qemu reports it, e.g. running, paused, guest-panicked, only set when it's running
+	Status string
+	// How the last run ended when it isn't running, -1 if it was killed or we never saw it exit
+	ExitCode int
+	// Whether it isn't running because it was suspended, and can be resumed
+	Suspended bool
+}
+
+// What a VM has of the things it needs to run
+type GuestResources struct {
+	Disk    bool
+	Network NetworkState
+}
+
+// What a guest is using, the process figures are only set while it's running
+type GuestUsage struct {
+	Running bool
+	// User and system CPU time of the qemu process
+	CPUSeconds float64
+	// Resident memory of the qemu process
+	RSSBytes int64
+	// Space the disk takes up on the host, and the size the guest sees
+	DiskAllocatedBytes int64
+	DiskSizeBytes      int64
+}
+
+// Only one terminal session on a console at a time
+var errConsoleBusy = errors.New("console is in use")
+
+// Restore has nothing to start a guest with, e.g. its create never got as far as qemu, so it needs a fresh Start
+var errNoArgs = errors.New("no saved qemu arguments")
+
+// The backend in use, picked with -backend when we start
+var backend VMBackend
+
+// Called by the backend whenever a guest stops by itself for good, i.e. it powered off or won't be restarted after
+// crashing, so the registry hears about it straight away rather than the next time anyone syncs
+// It's never called with the backend's lock held, and isn't called for guests we stopped ourselves
+var guestStopped func(vmId int)
+
+// The power actions a backend has to support
+var powerActions = map[string]bool{
+	"powerdown": true,
+	"reset":     true,
+	"stop":      true,
+	"cont":      true,
+}
+
+func newBackend(name string, networkName string) (VMBackend, error) {
+	switch name {
+	case "qemu":
+		// Pick up any guests that kept running while we were down
+		err := supervisor.adopt()
+		if err != nil {
+			return nil, err
+		}
+		// Bring the host side of the network in line with the VMs we have
+		network, err = newHostNetwork(networkName)
+		if err != nil {
+			return nil, err
+		}
+		return &qemuBackend{}, network.Restore()
+	case "fake":
+		return newFakeBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q, expected qemu or fake", name)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every guest's serial console is a unix socket, and we read it into console.log for as long as the guest runs
+// The log is a ring of two files, console.log and console.log.1, so a guest spewing output can't fill the disk, but
+// there's always the last consoleLogSize of it to see why a VM never came up
+
+// console.log is moved to console.log.1 once it gets this big
+const consoleLogSize = 512 * 1024
+
+// How much /vm/N/console/log returns if it isn't asked for an amount, and the most it will return
+const consoleTailDefault = 64
+const consoleTailMax = 2 * consoleLogSize / 1024
+
+func consoleSocket(vmId int) string {
+	return vmDir(vmId) + "/console.sock"
+}
+
+func consoleLogFile(vmId int) string {
+	return vmDir(vmId) + "/console.log"
+}
+
+// The ring buffered log of one guest's console
+type consoleLog struct {
+	mux  sync.Mutex
+	vmId int
+	f    *os.File
+	size int64
+}
+
+func openConsoleLog(vmId int) (*consoleLog, error) {
+	f, err := os.OpenFile(consoleLogFile(vmId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &consoleLog{vmId: vmId, f: f, size: info.Size()}, nil
+}
+
+func (c *consoleLog) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.size+int64(len(p)) > consoleLogSize {
+		err := c.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.f.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// Start a new console.log, keeping the old one as console.log.1, the caller must hold the lock
+func (c *consoleLog) rotate() error {
+	c.f.Close()
+	err := os.Rename(consoleLogFile(c.vmId), consoleLogFile(c.vmId)+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.f, err = os.OpenFile(consoleLogFile(c.vmId), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	c.size = 0
+	return nil
+}
+
+func (c *consoleLog) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.f.Close()
+}
+
+// A guest's console while we're connected to it, which terminal sessions can listen to and type into
+type liveConsole struct {
+	mux       sync.Mutex
+	conn      net.Conn
+	listeners map[chan []byte]bool
+	// Only one person types at a time
+	attached bool
+}
+
+var liveConsoles = struct {
+	mux      sync.Mutex
+	consoles map[int]*liveConsole
+}{consoles: make(map[int]*liveConsole)}
+
+func getLiveConsole(vmId int) *liveConsole {
+	liveConsoles.mux.Lock()
+	defer liveConsoles.mux.Unlock()
+
+	return liveConsoles.consoles[vmId]
+}
+
+// Pass console output on to everyone listening, dropping it for anyone too slow to keep up
+func (c *liveConsole) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for ch := range c.listeners {
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		select {
+		case ch <- buf:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Listen to console output, the channel is closed when we lose the console
+func (c *liveConsole) listen() chan []byte {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	ch := make(chan []byte, 64)
+	if c.listeners == nil {
+		close(ch)
+		return ch
+	}
+	c.listeners[ch] = true
+	return ch
+}
+
+func (c *liveConsole) unlisten(ch chan []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.listeners[ch] {
+		delete(c.listeners, ch)
+		close(ch)
+	}
+}
+
+// Hang up on everyone once the connection to qemu has gone
+func (c *liveConsole) closeListeners() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for ch := range c.listeners {
+		close(ch)
+	}
+	c.listeners = nil
+}
+
+// Claim the console for a terminal session, false if someone else has it
+func (c *liveConsole) claim() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.attached {
+		return false
+	}
+	c.attached = true
+	return true
+}
+
+func (c *liveConsole) release() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.attached = false
+}
+
+// A terminal session on a guest's console, reading gets its output and writing types into it
+type consoleSession struct {
+	live    *liveConsole
+	ch      chan []byte
+	pending []byte
+	once    sync.Once
+}
+
+// Start a terminal session, if the console is there and no one else has it
+func attachConsole(vmId int) (*consoleSession, error) {
+	live := getLiveConsole(vmId)
+	if live == nil {
+		return nil, errors.New("console not connected")
+	}
+	if !live.claim() {
+		return nil, errConsoleBusy
+	}
+	return &consoleSession{live: live, ch: live.listen()}, nil
+}
+
+func (s *consoleSession) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		buf, ok := <-s.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		s.pending = buf
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *consoleSession) Write(p []byte) (int, error) {
+	return s.live.conn.Write(p)
+}
+
+func (s *consoleSession) Close() error {
+	s.once.Do(func() {
+		s.live.unlisten(s.ch)
+		s.live.release()
+	})
+	return nil
+}
+
+// Read a guest's console into its log until the guest exits, done is closed when it does
+// qemu only takes one connection on the socket, so we're the only reader, everyone else reads the log or listens to us
+func watchConsole(vmId int, done chan struct{}) {
+	log, err := openConsoleLog(vmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening console log for vm%v: %v\n", vmId, err)
+		return
+	}
+	defer log.Close()
+
+	for {
+		// qemu may not have made the socket yet, and if we lose it we want it back
+		conn, err := net.DialTimeout("unix", consoleSocket(vmId), 5*time.Second)
+		if err == nil {
+			go func() {
+				<-done
+				conn.Close()
+			}()
+
+			live := &liveConsole{conn: conn, listeners: make(map[chan []byte]bool)}
+			liveConsoles.mux.Lock()
+			liveConsoles.consoles[vmId] = live
+			liveConsoles.mux.Unlock()
+
+			_, err = io.Copy(io.MultiWriter(log, live), conn)
+			conn.Close()
+
+			liveConsoles.mux.Lock()
+			if liveConsoles.consoles[vmId] == live {
+				delete(liveConsoles.consoles, vmId)
+			}
+			liveConsoles.mux.Unlock()
+			live.closeListeners()
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// The last size bytes of a guest's console, from both files of the ring
+func consoleTail(vmId int, size int64) ([]byte, error) {
+	var out []byte
+	for _, name := range []string{consoleLogFile(vmId) + ".1", consoleLogFile(vmId)} {
+		buf, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, buf...)
+	}
+	if int64(len(out)) > size {
+		out = out[int64(len(out))-size:]
+	}
+	return out, nil
+}
+
+// The end of a guest's console output, e.g. /vm/100/console/log?kib=64
+func consoleLogHandler(w http.ResponseWriter, r *http.Request, vmId int) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kib := consoleTailDefault
+	if r.URL.Query().Get("kib") != "" {
+		var err error
+		kib, err = strconv.Atoi(r.URL.Query().Get("kib"))
+		if err != nil || kib < 1 {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		if kib > consoleTailMax {
+			kib = consoleTailMax
+		}
+	}
+
+	out, err := backend.ConsoleLog(vmId, kib*1024)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading console of vm%v: %v\n", vmId, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A guest's qemu process can be perfectly happy while the kernel inside it has panicked or sshd has died, so we also
+// check every running guest answers on 10.0.N.25:22 across its bridge
+// Health is one of:
+//   booting      it hasn't answered since it started, but it's still early
+//   healthy      it answered recently
+//   unreachable  it hasn't answered healthFailures times in a row, or never did within healthBootGrace
+// and is empty for guests that aren't running. It's only what we've seen since we started, so it isn't saved.
+
+// How often every running guest is checked
+const healthInterval = 30 * time.Second
+
+// How long a guest has to accept the connection
+const healthTimeout = 5 * time.Second
+
+// A healthy guest has to miss this many checks in a row before we call it unreachable, so a busy moment doesn't count
+const healthFailures = 3
+
+// How long a guest gets to boot before never having answered makes it unreachable
+const healthBootGrace = 5 * time.Minute
+
+// What we know about one guest's checks, since we last saw it start
+type healthTracker struct {
+	// When we first saw it running
+	since time.Time
+	// Whether it has answered at all since then
+	answered bool
+	// Failed checks since it last answered
+	failures int
+	health   string
+}
+
+// Check every running guest, forever
+func (v *VMList) probeHealth() {
+	trackers := make(map[int]*healthTracker)
+	for {
+		guests := backend.List()
+
+		// Forget guests that aren't running, so they start from booting when they come back
+		for id := range trackers {
+			if !guests[id].Running {
+				delete(trackers, id)
+			}
+		}
+
+		// Every check at once, so a few unreachable guests don't hold up the rest
+		var wg sync.WaitGroup
+		var mux sync.Mutex
+		results := make(map[int]bool)
+		for id, guest := range guests {
+			if !guest.Running {
+				continue
+			}
+			if trackers[id] == nil {
+				trackers[id] = &healthTracker{since: time.Now(), health: "booting"}
+			}
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				ok := probeGuest(id)
+				mux.Lock()
+				results[id] = ok
+				mux.Unlock()
+			}(id)
+		}
+		wg.Wait()
+
+		for id, ok := range results {
+			trackers[id].record(ok)
+		}
+
+		v.mux.Lock()
+		for id, vminfo := range v.Vms {
+			health := ""
+			if t, ok := trackers[id]; ok {
+				health = t.health
+			}
+			if vminfo.Health != health {
+				if health == "unreachable" {
+					fmt.Println(fmt.Sprintf("[%v] vm%v is unreachable", time.Now(), id))
+				}
+				vminfo.Health = health
+				v.Vms[id] = vminfo
+			}
+		}
+		v.mux.Unlock()
+
+		time.Sleep(healthInterval)
+	}
+}
+
+// Whether sshd on the guest accepts a connection
+func probeGuest(vmId int) bool {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("10.0.%v.25:22", vmId), healthTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (t *healthTracker) record(ok bool) {
+	if ok {
+		t.answered = true
+		t.failures = 0
+		t.health = "healthy"
+		return
+	}
+
+	t.failures++
+	if !t.answered {
+		if time.Since(t.since) > healthBootGrace {
+			t.health = "unreachable"
+		}
+		return
+	}
+	if t.failures >= healthFailures {
+		t.health = "unreachable"
+	}
+}
@@ -1,22 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
 	"strconv"
+	"strings"
 	"sync"
-	"text/template"
 	"time"
 )
 
+// How long we'll wait for tor on the pi to become usable while creating a VM, and how often we check
+const gatewayWait = 15 * time.Minute
+const gatewayRetryInterval = 30 * time.Second
+
 // A struct to hold the list of VMs
 type VMList struct {
 	mux sync.Mutex
@@ -27,9 +29,21 @@ type VMInformation struct {
 	URL    string
 	Status string
 	Id     int
+	// The name of the plan and ID of the image it was created with, empty if we've lost track of them
+	Plan  string
+	Image string
+	// When we were asked to create it, zero for guests we found running without a record
+	Created time.Time
+	// Whether to start it again after the host reboots
+	Autostart bool
+	// Whether it's meant to be running, which only changes when it's started or stopped on purpose, by its owner,
+	// us or the supervisor giving up on it, and not when it's only down because the host rebooted
+	ShouldRun bool
+	// Whether the guest answers on port 22, see health.go
+	Health string
 }
 
-func (v *VMList) addVM(vmId int, status string, url string) error {
+func (v *VMList) addVM(vmId int, status string, url string, plan string, image string) error {
 	// VMs < 50 are reserved for administrative use
 	if vmId < 50 || vmId > 254 {
 		return errors.New("invalid")
@@ -45,7 +59,14 @@ func (v *VMList) addVM(vmId int, status string, url string) error {
 	}
 
 	// It's both valid and not in use!
-	vm := VMInformation{Id: vmId, Status: status, URL: url}
+	vm := VMInformation{Id: vmId, Status: status, URL: url, Plan: plan, Image: image, Created: time.Now(), Autostart: true}
+
+	// A VM we can't record would be forgotten the next time we restart, so don't create it at all
+	err := saveVM(vm)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", vmId, err)
+		return errors.New("unavailable")
+	}
 	v.Vms[vmId] = vm
 
 	return nil // no errors
@@ -62,6 +83,11 @@ func (v *VMList) removeVM(vmId int) error {
 
 	delete(v.Vms, vmId)
 
+	err := store.DeleteVM(vmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing vm%v from the registry: %v\n", vmId, err)
+	}
+
 	return nil
 }
 
@@ -74,88 +100,223 @@ func (v *VMList) updateVM(vmId int, status string, url string) error {
 		return errors.New("Invalid vmId specified")
 	}
 
-	VMInfo := VMInformation{URL: url, Status: status, Id: vmId}
+	// Keep everything else we know about it
+	VMInfo := v.Vms[vmId]
+	VMInfo.URL = url
+	VMInfo.Status = status
 	v.Vms[vmId] = VMInfo
 
+	err := saveVM(VMInfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", vmId, err)
+	}
+
 	return nil
 }
 
 func (v *VMList) sync() error {
-	// Shell out to get a list of screen sessions, which are VMs
-	out, err := exec.Command("screen", "-ls").Output()
-	if err != nil {
-		return errors.New("Error running screen")
-	}
+	// Every guest the backend is looking after, running or not
+	guests := backend.List()
 
 	// Our new map
 	newvms := make(map[int]VMInformation)
 
-	// Regex out the running VM IDs
-	re := regexp.MustCompile(`\b\.vm([0-9]+)\b`)
-
-	matches := re.FindAllStringSubmatch(string(out), -1)
-
 	// We only need to start locking now, to ensure we read a valid state
 	v.mux.Lock()
-	defer v.mux.Unlock()
 
-	for i := 0; i < len(matches); i++ {
-		// Ignore invalid VMs
-		id, err := strconv.Atoi(matches[i][1])
-		if err == nil {
-			// Create a new struct for it
-			// Only get the state of it already exists
-			var vminfo VMInformation
-			if val, ok := v.Vms[id]; ok {
-				vminfo = val
-			} else {
-				vminfo = VMInformation{Id: id, Status: "running"}
-			}
-			// Look up the URL if required
-			if newvms[id].URL == "" {
-				resp, err := http.Get(fmt.Sprintf("http://10.0.0.5/view/%v", id))
-				if err != nil {
-					vminfo.Status = "broken"
-					newvms[id] = vminfo
-					fmt.Fprintln(os.Stderr, "error talking to torcontrol: %v", err)
-					continue
-				}
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					vminfo.Status = "broken"
-					newvms[id] = vminfo
-					fmt.Fprintln(os.Stderr, "error getting response from torcontrol: %v", err)
-					continue
-				}
-				status := string(body)
-				// Close the response body
-				resp.Body.Close()
-				if status == "invalid" || status == "unknown" {
-					vminfo.Status = "broken"
-					newvms[id] = vminfo
-					continue
-				}
-				vminfo.URL = status
-				vminfo.Status = "running"
-				newvms[id] = vminfo
+	for id, guest := range guests {
+		// Create a new struct for it
+		// Only get the state of it already exists
+		var vminfo VMInformation
+		if val, ok := v.Vms[id]; ok {
+			vminfo = val
+		} else {
+			vminfo = VMInformation{Id: id, Status: "running", Autostart: true, ShouldRun: true}
+		}
+		// Creation and deletion set the status themselves once they're done
+		if vminfo.Status == "creating" || vminfo.Status == "deleting" {
+			newvms[id] = vminfo
+			continue
+		}
+		// It powered itself off, or crashed more often than we're willing to restart it, unless it was suspended
+		if !guest.Running {
+			vminfo.Status = stoppedStatus(guest)
+			newvms[id] = vminfo
+			continue
+		}
+		guestStatus := guest.Status
+		vminfo.Status = guestStatus
+
+		// Look up the URL, torcontrol being unhappy doesn't change what the guest is doing
+		resp, err := controlGet(fmt.Sprintf("https://10.0.0.5/view/%v", id))
+		if err != nil {
+			newvms[id] = vminfo
+			fmt.Fprintf(os.Stderr, "error talking to torcontrol: %v\n", err)
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		// Close the response body
+		resp.Body.Close()
+		if err != nil {
+			newvms[id] = vminfo
+			fmt.Fprintf(os.Stderr, "error getting response from torcontrol: %v\n", err)
+			continue
+		}
+		status := string(body)
+		if status == "gateway-not-ready" {
+			// Tor isn't usable right now, keep the URL we knew about but don't pretend it works
+			if guestStatus == "running" {
+				vminfo.Status = "gateway-not-ready"
 			}
+			newvms[id] = vminfo
+			continue
+		}
+		if status == "invalid" || status == "unknown" {
+			newvms[id] = vminfo
+			continue
+		}
+		vminfo.URL = status
+		newvms[id] = vminfo
+	}
+
+	// The registry says what VMs exist, so ones without a process haven't gone anywhere, they're just not running
+	// That's normal after the host reboots, and VMs part way through being created or deleted may not have been started
+	// Suspended ones stay that way until they're resumed
+	for id, vminfo := range v.Vms {
+		if _, ok := newvms[id]; ok {
+			continue
+		}
+		if vminfo.Status != "creating" && vminfo.Status != "deleting" && vminfo.Status != "broken" && vminfo.Status != "suspended" {
+			vminfo.Status = "stopped"
+		}
+		newvms[id] = vminfo
+	}
+
+	// Write through whatever changed, once we've let go of the lock
+	var changed []VMInformation
+	for id, vminfo := range newvms {
+		if old, ok := v.Vms[id]; !ok || old != vminfo {
+			changed = append(changed, vminfo)
 		}
 	}
 
 	// Now replace the map
 	v.Vms = newvms
+	v.mux.Unlock()
+
+	err := saveVMs(changed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving VMs to the registry: %v\n", err)
+	}
 
 	return nil // no error!
 }
 
+// What a guest that isn't running is, from how it stopped
+func stoppedStatus(guest GuestState) string {
+	if guest.Suspended {
+		return "suspended"
+	}
+	if guest.ExitCode == 0 {
+		return "stopped"
+	}
+	return "broken"
+}
+
+// A guest stopped without us asking it to, it powered itself off or crashed once too often, so record that now
+// rather than leaving the registry saying it's running until the next sync
+func (v *VMList) guestStopped(vmId int) {
+	state, err := backend.Inspect(vmId)
+	if err != nil || state.Running {
+		return
+	}
+
+	v.mux.Lock()
+	vminfo, exists := v.Vms[vmId]
+	// Creation and deletion set the status themselves once they're done
+	if !exists || vminfo.Status == "creating" || vminfo.Status == "deleting" {
+		v.mux.Unlock()
+		return
+	}
+	vminfo.Status = stoppedStatus(state)
+	vminfo.ShouldRun = false
+	v.Vms[vmId] = vminfo
+	v.mux.Unlock()
+
+	fmt.Println(fmt.Sprintf("[%v] vm%v stopped by itself, it's now %v", time.Now(), vmId, vminfo.Status))
+	err = saveVM(vminfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", vmId, err)
+	}
+}
+
 func main() {
 	os.Exit(run())
 }
 
 func run() int {
+	backendName := flag.String("backend", "qemu", "what runs the VMs, qemu or fake")
+	networkName := flag.String("network", "openrc", "how the qemu backend sets up bridges and vlans, openrc or netlink")
+	listen := flag.String("listen", "10.0.5.20:443", "address to serve on")
+	metricsListen := flag.String("metrics", "10.0.5.20:9443", "address to serve /metrics on, for the prometheus role only")
+	flag.DurationVar(&onionDeadline, "onion-deadline", onionDeadline, "how long creating a VM waits for tor to give it a hostname")
+	flag.StringVar(&registryKey, "registry", registryKey, "redis hash to keep our VMs in")
+	flag.Parse()
+
+	// Requests to and from the other daemons are signed, so we can't do anything without the key
+	err := loadControlKey()
+	if err != nil {
+		fmt.Printf("Could not read %v: %v\n", controlKeyFile, err)
+		return 1
+	}
+
+	// Same for our certificate, there is no falling back to plain HTTP
+	err = loadTLS()
+	if err != nil {
+		fmt.Printf("Could not load TLS configuration: %v\n", err)
+		return 1
+	}
+	torcontrolClient = clientForRole("torcontrol-daemon")
+
+	// The plans VMs can be created with
+	err = loadPlans()
+	if err != nil {
+		fmt.Printf("Could not load %v: %v\n", plansFile, err)
+		return 1
+	}
+
+	// And the images they can be created from
+	err = loadImages()
+	if err != nil {
+		fmt.Printf("Could not load %v: %v\n", imagesFile, err)
+		return 1
+	}
+
 	// Get our VM struct working
-	v := VMList{Vms: make(map[int]VMInformation)}
-	v.sync()
+	v := &VMList{Vms: make(map[int]VMInformation)}
+	guestStopped = v.guestStopped
+	backend, err = newBackend(*backendName, *networkName)
+	if err != nil {
+		fmt.Printf("Could not set up the %v backend: %v\n", *backendName, err)
+		return 1
+	}
+
+	// Which images are usable depends on the backend
+	err = checkImages()
+	if err != nil {
+		fmt.Printf("Could not load %v: %v\n", imagesFile, err)
+		return 1
+	}
+
+	// Pick up where we left off, then check that against what's actually running
+	err = v.reconcile()
+	if err != nil {
+		fmt.Printf("Could not load our VMs from the registry: %v\n", err)
+		return 1
+	}
+
+	// Keep an eye on whether the guests actually answer
+	go v.probeHealth()
 
 	// Connect here rather than in the handler so that we can ensure we can connect and exit if need be
 	{
@@ -170,30 +331,71 @@ func run() int {
 
 	}
 
+	// Metrics get their own server, so the scraper's certificate can't be used for anything else
+	metrics := http.NewServeMux()
+	metrics.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(w, r, v)
+	})
+	go func() {
+		metricsServer := &http.Server{Addr: *metricsListen, Handler: metrics, TLSConfig: serverTLSConfig("prometheus")}
+		err := metricsServer.ListenAndServeTLS("", "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not start metrics server: %v\n", err)
+		}
+	}()
+
+	// Only bind to one interface -- IMPORTANT
+	// Only the frontend has any business talking to us
+	server := &http.Server{Addr: *listen, Handler: newMux(v), TLSConfig: serverTLSConfig("webserver-frontend")}
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		fmt.Printf("Could not start server: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// Everything the frontend can ask of us, every request has to be signed
+func newMux(v *VMList) *http.ServeMux {
+	mux := http.NewServeMux()
+
 	// Get the current numbers and data about VMs
-	http.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/sync", requireSignature(func(w http.ResponseWriter, r *http.Request) {
 		syncHandler(w, r, v)
-	})
+	}))
 
 	// View information about a given VM
-	http.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/view/", requireSignature(func(w http.ResponseWriter, r *http.Request) {
 		viewHandler(w, r, v)
-	})
+	}))
 
-	// Create a new VM of a given ID
-	http.HandleFunc("/create/", func(w http.ResponseWriter, r *http.Request) {
-		createHandler(w, r, v)
-	})
+	// Actions on a single VM, e.g. /vm/100/power
+	mux.HandleFunc("/vm/", requireSignature(func(w http.ResponseWriter, r *http.Request) {
+		vmHandler(w, r, v)
+	}))
 
-	// Only bind to one interface -- IMPORTANT
-	http.ListenAndServe("10.0.5.20:80", nil)
+	// The plans we can create VMs with
+	mux.HandleFunc("/plans", requireSignature(plansHandler))
 
-	return 0
+	// The images we can create VMs from
+	mux.HandleFunc("/images", requireSignature(imagesHandler))
+
+	// How a create, delete or snapshot is getting on, e.g. /jobs/0123456789abcdef
+	mux.HandleFunc("/jobs/", requireSignature(jobsHandler))
+
+	// Create a new VM of a given ID, e.g. /create/100?plan=small&image=gentoo-vanilla-v3
+	mux.HandleFunc("/create/", requireSignature(func(w http.ResponseWriter, r *http.Request) {
+		createHandler(w, r, v)
+	}))
+
+	return mux
 }
 
-func redisPubSubHandle(redisCon redis.Conn, vmlist VMList) {
+func redisPubSubHandle(redisCon redis.Conn, vmlist *VMList) {
 	psc := redis.PubSubConn{Conn: redisCon}
 	psc.Subscribe("deletevm")
+	psc.Subscribe("onionready")
 
 	for {
 		// TODO Can we use an if/continue instead of a switch?
@@ -201,85 +403,111 @@ func redisPubSubHandle(redisCon redis.Conn, vmlist VMList) {
 		case redis.Message:
 			switch v.Channel {
 			case "deletevm":
-				// Parse out the ID and if required, do the deed
-				vmId, err := strconv.Atoi(string(v.Data))
-				// Check whether the ID is valid
-				if err != nil {
-					continue
-				}
-				if vmId < 50 || vmId > 255 {
-					return
-				}
-
-				go deleteVm(vmId, vmlist)
+				go deleteVMMessage(v.Data, vmlist)
+			case "onionready":
+				// torcontrol has a hostname for a VM we may be creating
+				onionReady(v.Data)
 			}
 		}
 		fmt.Println(fmt.Sprintf("[%v] Got a PUBSUB message", time.Now()))
 	}
 }
 
-func deleteVm(vmId int, v VMList) {
-	// Change state
-	v.updateVM(vmId, "deleting", v.Vms[vmId].URL)
-
-	// Remove the screen session
-	cmd := exec.Command("screen", "-X", "-S", fmt.Sprintf("vm%v", vmId), "quit")
-	out, err := cmd.Output()
-	outStr := string(out)
+// Handle a message on deletevm, the data is the VM's ID
+func deleteVMMessage(data []byte, v *VMList) {
+	// Parse out the ID and if required, do the deed
+	vmId, err := strconv.Atoi(string(data))
+	// Check whether the ID is valid
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error starting screen session for new VM: %v \r\nadditional: %v", err, outStr)
 		return
 	}
-
-	// deactivate the bridge
-	err = exec.Command(fmt.Sprintf("/etc/init.d/net.br%v", vmId), "stop").Run()
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error executing bridge restart for new VM: %v", err)
+	if vmId < 50 || vmId > 254 {
 		return
 	}
 
-	// Bring down the vlan
-	out, err = exec.Command("ip", "link", "del", fmt.Sprintf("enp3s0.%v", vmId)).Output()
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("error removing vlan: %v %s", err, out))
-		return
+	// Let everyone know how it went, the frontend won't reuse the ID until we do
+	publishDeleted(vmId, deleteVm(vmId, v))
+}
+
+// Acknowledge a deletevm message on the vmdeleted channel, with the error if we failed
+func publishDeleted(vmId int, deleteErr error) {
+	ack := struct {
+		Id        int
+		Component string
+		Error     string
+	}{Id: vmId, Component: "hypervisor-daemon"}
+	if deleteErr != nil {
+		ack.Error = deleteErr.Error()
 	}
 
-	// Remove autostart of bridge
-	err = exec.Command("rc-update", "del", fmt.Sprintf("net.br%v", vmId)).Run()
+	b, err := json.Marshal(ack)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error removing bridge from default runlevel: %v", err)
+		fmt.Fprintf(os.Stderr, "error json encoding deletion acknowledgement: %v\n", err)
 		return
 	}
 
-	// Remove the bridge symlink
-	err = os.Remove(fmt.Sprintf("/etc/init.d/net.br%v", vmId))
+	err = store.Publish("vmdeleted", b)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error creating bridge symilnk for new VM: %v", err)
-		return
+		fmt.Fprintf(os.Stderr, "error publishing deletion acknowledgement: %v\n", err)
+	}
+}
+
+func deleteVm(vmId int, v *VMList) (err error) {
+	start := time.Now()
+	job := newJob("delete", vmId, deleteSteps...)
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		deleteDuration.observe(result, time.Since(start))
+		job.finish(err)
+	}()
+
+	// Change state
+	v.updateVM(vmId, "deleting", v.Vms[vmId].URL)
+
+	// Stop it if it's running, and make sure it isn't restarted behind our back
+	// Nothing else can go while it runs, so this is the one failure we stop at
+	job.step("qemu")
+	if state, inspectErr := backend.Inspect(vmId); inspectErr == nil && state.Running {
+		err = backend.Stop(vmId)
+		if err != nil {
+			v.updateVM(vmId, "broken", "")
+			fmt.Fprintf(os.Stderr, "error stopping VM: %v\n", err)
+			return err
+		}
 	}
 
-	// Remove the disk image
-	err = os.RemoveAll(fmt.Sprintf("/root/vm-images/vm%v/", vmId))
+	// Tear down its network and disk, the backend skips whatever is already gone, and we carry on past failures so
+	// we remove as much as we can
+	job.step("network")
+	netErr := backend.DetachNetwork(vmId)
+	if netErr != nil {
+		fmt.Fprintf(os.Stderr, "error detaching network: %v\n", netErr)
+		job.stepFailed(netErr)
+	}
+	job.step("disk")
+	err = backend.RemoveDisk(vmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing disk: %v\n", err)
+		job.stepFailed(err)
+	}
+	if netErr != nil && err == nil {
+		err = netErr
+	}
 	if err != nil {
 		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error removing disk image VM: %v", err)
-		return
+		return err
 	}
 
 	// Complete deletion by removing it from the list of VMs
 	v.removeVM(vmId)
 
-	// We really should regenerate our net file here, but if we don't, it's not the end of the world (sucks to be the person to clean up after the reboot HA
-	// TODO ^ I'm going to regret this later, fix it
+	return nil
 }
 
-func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
+func viewHandler(w http.ResponseWriter, r *http.Request, v *VMList) {
 	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
 	vmIdStr := r.URL.Path[len("/view/"):]
 	vmId, err := strconv.Atoi(vmIdStr)
@@ -296,16 +524,120 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	}
 
 	// Confirm there is a vm running
-	if _, exists := v.Vms[vmId]; !exists {
+	v.mux.Lock()
+	vminfo, exists := v.Vms[vmId]
+	v.mux.Unlock()
+	if !exists {
 		fmt.Fprintf(w, "invalid")
 		return
 	}
 
+	// Everything we know about it, e.g. /view/100?format=json
+	if r.URL.Query().Get("format") == "json" {
+		b, err := json.Marshal(vminfo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error json encoding vm%v: %v\n", vmId, err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+
+	// Until we have a URL, the status is the most useful thing we can give back
+	if vminfo.URL == "" {
+		fmt.Fprint(w, vminfo.Status)
+		return
+	}
+
 	// valid and running
-	fmt.Fprintf(w, v.Vms[vmId].URL)
+	fmt.Fprint(w, vminfo.URL)
+}
+
+// Dispatch /vm/N/action requests to the handler for that action
+func vmHandler(w http.ResponseWriter, r *http.Request, v *VMList) {
+	fmt.Println(fmt.Sprintf("[%v] %v %v", time.Now(), r.Method, r.URL.Path))
+	parts := strings.SplitN(r.URL.Path[len("/vm/"):], "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "invalid", http.StatusNotFound)
+		return
+	}
+
+	vmId, err := strconv.Atoi(parts[0])
+	// VMs < 50 are reserved for administrative use
+	if err != nil || vmId < 50 || vmId > 254 {
+		http.Error(w, "invalid", http.StatusNotFound)
+		return
+	}
+	v.mux.Lock()
+	_, exists := v.Vms[vmId]
+	v.mux.Unlock()
+	if !exists {
+		http.Error(w, "invalid", http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "power":
+		powerHandler(w, r, vmId)
+	case "snapshot":
+		snapshotHandler(w, r, vmId, v)
+	case "autostart":
+		autostartHandler(w, r, vmId, v)
+	case "console/log":
+		consoleLogHandler(w, r, vmId)
+	case "console/attach":
+		terminalHandler(w, r, vmId)
+	case "repair":
+		repairHandler(w, r, vmId, v)
+	case "suspend", "resume":
+		suspendHandler(w, r, vmId, v, parts[1])
+	default:
+		http.Error(w, "invalid", http.StatusNotFound)
+	}
+}
+
+// Power actions for a guest, through the backend
+func powerHandler(w http.ResponseWriter, r *http.Request, vmId int) {
+	if r.Method == "GET" {
+		// Just report the state
+		state, err := backend.Inspect(vmId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error inspecting vm%v: %v\n", vmId, err)
+			http.Error(w, "unknown", http.StatusServiceUnavailable)
+			return
+		}
+		if !state.Running {
+			fmt.Fprintf(w, "stopped")
+			return
+		}
+		fmt.Fprint(w, state.Status)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The action comes in the query string, so it is covered by the request signature
+	action := r.URL.Query().Get("action")
+	if !powerActions[action] {
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+
+	err := backend.Power(vmId, action)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error running %v on vm%v: %v\n", action, vmId, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "ok")
 }
 
-func syncHandler(w http.ResponseWriter, r *http.Request, v VMList) {
+func syncHandler(w http.ResponseWriter, r *http.Request, v *VMList) {
 	v.sync()
 	// build a new map of data that json can encode
 	inter := make(map[string]VMInformation)
@@ -321,7 +653,7 @@ func syncHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	w.Write(b)
 }
 
-func createHandler(w http.ResponseWriter, r *http.Request, v VMList) {
+func createHandler(w http.ResponseWriter, r *http.Request, v *VMList) {
 	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
 	vmIdStr := r.URL.Path[len("/create/"):]
 	vmId, err := strconv.Atoi(vmIdStr)
@@ -331,162 +663,200 @@ func createHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 		return
 	}
 
-	err = v.addVM(vmId, "creating", "")
-	if err != nil {
-		fmt.Fprintf(w, fmt.Sprintf("%v", err))
-		return
-	}
-
-	// No error means we're ready to start the VM
-	// Fork off a new thread to do the creation then let the user know we've started
-	go createVM(vmId, v)
-	fmt.Fprintf(w, "creating")
-}
-
-func createVM(vmId int, v VMList) {
-	// This function assumes it's already been put into VMInformation
-	// TODO: Write a validator for above asumption ^
-
-	// Create a new directory for the VM disk image
-	err := os.Mkdir(fmt.Sprintf("/root/vm-images/vm%v", vmId), 0755)
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error creating disk image directory for new VM: %v", err)
-		return
+	// Which resources it gets, older frontends don't ask for a plan
+	planName := r.URL.Query().Get("plan")
+	if planName == "" {
+		planName = defaultPlan
 	}
-
-	// Create new disk image
-	err = exec.Command("qemu-img", "create", "-f", "qcow2", "-o", "backing_file=/root/vm-images/base-gentoo-vanilla-v3.img", fmt.Sprintf("/root/vm-images/vm%v/vm%v-gentoo-vanilla-v3.img", vmId, vmId)).Run()
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error creating disk image for new VM: %v", err)
+	plan, ok := findPlan(planName)
+	if !ok {
+		fmt.Fprintf(w, "invalid")
 		return
 	}
 
-	// Create our network bridge and configuration
-	// TODO: Do we need to lock the datastructure here? We might write network information for a VM that isn't made yet
-	t, err := template.ParseFiles("assets/net")
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error creating template for new VM: %v", err)
-		return
+	// And which base image, the same goes for that
+	imageId := r.URL.Query().Get("image")
+	if imageId == "" {
+		imageId = defaultImage
 	}
-	var net bytes.Buffer
-	err = t.Execute(&net, v)
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error executing template for new VM: %v", err)
+	img, ok := findImage(imageId)
+	if !ok || !img.usable() {
+		fmt.Fprintf(w, "invalid")
 		return
 	}
 
-	// Write the file
-	err = ioutil.WriteFile("/etc/conf.d/net", net.Bytes(), 0644)
+	err = v.addVM(vmId, "creating", "", plan.Name, img.Id)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error writing net template for new VM: %v", err)
+		fmt.Fprint(w, err)
 		return
 	}
 
-	// Create the symlink for the bridge
-	err = os.Symlink("/etc/init.d/net.bridge", fmt.Sprintf("/etc/init.d/net.br%v", vmId))
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintf(os.Stderr, "error creating bridge symilnk for new VM: %v", err)
-		return
-	}
+	// No error means we're ready to start the VM
+	// Fork off a new thread to do the creation then let the user know we've started, and how to follow it
+	job := newJob("create", vmId, createSteps...)
+	go createVM(vmId, plan, img, v, job)
+	w.Header().Set("X-Job-Id", job.Id)
+	fmt.Fprintf(w, "creating")
+}
 
-	// Manually bring up the new vlan
-	out, err := exec.Command("ip", "link", "add", "link", "enp3s0", "name", fmt.Sprintf("enp3s0.%v", vmId), "type", "vlan", "id", fmt.Sprintf("%v", vmId)).Output()
-	if err != nil {
+func createVM(vmId int, plan Plan, img Image, v *VMList, job *trackedJob) {
+	// This function assumes it's already been put into VMInformation
+	// TODO: Write a validator for above asumption ^
+
+	// However it ends, it ends with a status of complete, broken, or gone if we rolled it back
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		v.mux.Lock()
+		if v.Vms[vmId].Status != "complete" {
+			result = "failed"
+		}
+		v.mux.Unlock()
+		createDuration.observe(result, time.Since(start))
+	}()
+
+	// Every step that worked, undone in reverse if a later one fails, so a failed create leaves nothing behind and the
+	// ID can be used again straight away
+	var undo []func() error
+	var err error
+	defer func() {
+		if err == nil {
+			job.finish(nil)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error creating vm%v, rolling back: %v\n", vmId, err)
 		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("error adding new vlan: %v %s", err, out))
-		return
-	}
+		undoErr := rollback(vmId, undo)
+		if undoErr != nil {
+			// Leave it broken, someone has to look at what's left
+			job.finish(fmt.Errorf("%v, and rolling back failed: %v", err, undoErr))
+			return
+		}
+		job.finish(fmt.Errorf("%v, rolled back", err))
+		v.removeVM(vmId)
+	}()
 
-	// Activate the new bridge
-	err = exec.Command(fmt.Sprintf("/etc/init.d/net.br%v", vmId), "start").Run()
+	// Create the disk image
+	job.step("disk")
+	err = backend.ProvisionDisk(vmId, plan, img)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error executing bridge restart for new VM: %v", err)
+		err = fmt.Errorf("provisioning disk: %v", err)
 		return
 	}
+	undo = append(undo, func() error {
+		return backend.RemoveDisk(vmId)
+	})
 
-	// Configure the bridge to start on boot
-	err = exec.Command("rc-update", "add", fmt.Sprintf("net.br%v", vmId), "default").Run()
+	// Create our network bridge and configuration, the network reports the vlan and bridge steps itself
+	// It cleans up after itself if it fails part way
+	job.step("vlan")
+	err = backend.AttachNetwork(vmId)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error adding bridge to default runlevel: %v", err)
+		err = fmt.Errorf("attaching network: %v", err)
 		return
 	}
+	undo = append(undo, func() error {
+		return backend.DetachNetwork(vmId)
+	})
 
-	// Create a new screen/qemu instance
-	cmd := exec.Command("screen", "-d", "-m", "-S", fmt.Sprintf("vm%v", vmId), "qemu-system-x86_64", "-nographic", "-enable-kvm", "-cpu", "host", "-curses", "-m", "512M", "-drive", fmt.Sprintf("file=/root/vm-images/vm%v/vm%v-gentoo-vanilla-v3.img,if=virtio", vmId, vmId), "-netdev", fmt.Sprintf("tap,helper=/usr/libexec/qemu-bridge-helper --br=br%v,id=hn0", vmId), "-device", "virtio-net-pci,netdev=hn0,id=nic1", "-append", fmt.Sprintf("root=/dev/vda4 ro vmid=%v", vmId), "-kernel", "/root/vm-images/kernels/vmlinuz-4.7.10-hardened")
-	// TODO: Find a way to check the error properly without using .Run() -- CHANGE TO .Start() else it won't work in futuer
-	out, err = cmd.Output()
-	outStr := string(out)
+	// Boot it
+	job.step("qemu")
+	err = backend.Start(vmId, plan, img)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error starting screen session for new VM: %v \r\nadditional: %v", err, outStr)
+		err = fmt.Errorf("starting qemu: %v", err)
 		return
 	}
+	v.setShouldRun(vmId, true)
+	undo = append(undo, func() error {
+		return backend.Stop(vmId)
+	})
 
 	// Talk to the raspberry pi about getting a new Tor set up
-	resp, err := http.Get(fmt.Sprintf("http://10.0.0.5/create/%v", vmId))
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error talking to torcontrol: %v", err)
-		return
+	// Only we decide what the owner sees while tor connects, nothing else using torcontrol should
+	gatewayNotReady := func() {
+		v.updateVM(vmId, "gateway-not-ready", "")
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	job.step("tor")
+	status, err := torcontrolRequest(fmt.Sprintf("https://10.0.0.5/create/%v", vmId), gatewayNotReady)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error getting response from torcontrol: %v", err)
+		err = fmt.Errorf("talking to torcontrol: %v", err)
 		return
 	}
-
-	// Determine if the final part, tor stuff, worked
-	status := string(body)
-
-	// Close the response body
-	resp.Body.Close()
-
 	if status != "creating" {
 		// TODO we should never get here, so handle this more strongly, it's probably an attack?
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("error talking to torcontrol, response then err: %v -- %v", status, err))
-		v.updateVM(vmId, "broken", "")
+		err = fmt.Errorf("unexpected response from torcontrol: %v", status)
 		return
 	}
+	undo = append(undo, func() error {
+		status, err := torcontrolRequest(fmt.Sprintf("https://10.0.0.5/delete/%v", vmId), nil)
+		if err != nil {
+			return err
+		}
+		if status != "ok" {
+			return fmt.Errorf("torcontrol could not remove it: %v", status)
+		}
+		return nil
+	})
 
-	// Wait a while for tor to generate it
-	time.Sleep(30 * time.Second)
-
-	// fetch the hostname
-	resp, err = http.Get(fmt.Sprintf("http://10.0.0.5/view/%v", vmId))
+	// Wait for tor to generate it
+	job.step("hostname")
+	status, err = waitForOnion(vmId, gatewayNotReady)
 	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error talking to torcontrol: %v", err)
+		err = fmt.Errorf("fetching hostname: %v", err)
 		return
 	}
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		v.updateVM(vmId, "broken", "")
-		fmt.Fprintln(os.Stderr, "error getting response from torcontrol: %v", err)
-		return
+
+	// Update VM status to be the onion address
+	v.updateVM(vmId, "complete", status)
+}
+
+// Run a failed create's undo actions in reverse, carrying on past failures so we remove as much as we can
+// Returns the first thing that went wrong
+func rollback(vmId int, undo []func() error) error {
+	var firstErr error
+	for i := len(undo) - 1; i >= 0; i-- {
+		err := undo[i]()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error rolling back vm%v: %v\n", vmId, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	if firstErr == nil {
+		fmt.Println(fmt.Sprintf("[%v] Rolled back vm%v", time.Now(), vmId))
+	}
+	return firstErr
+}
 
-	// Determine if the final part, tor stuff, worked
-	status = string(body)
+// Make a request to torcontrol on behalf of a VM and return the response
+// If tor on the pi isn't bootstrapped yet we keep trying for a while, since any onion it gave us wouldn't work anyway
+// notReady is called each time we find it isn't, for creating a VM to show the owner why it's waiting, it may be nil
+func torcontrolRequest(url string, notReady func()) (string, error) {
+	deadline := time.Now().Add(gatewayWait)
+	for {
+		resp, err := controlGet(url)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		// Close the response body
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
 
-	// Close the response body
-	resp.Body.Close()
+		status := string(body)
+		if status != "gateway-not-ready" {
+			return status, nil
+		}
 
-	if status == "invalid" || status == "unknown" {
-		// TODO we should never get here, so handle this more strongly, it's probably an attack?
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("error talking to torcontrol for hostname, response then status: %v -- %v", status, err))
-		v.updateVM(vmId, "broken", "")
-		return
+		if time.Now().After(deadline) {
+			return "", errors.New("tor gateway did not become ready in time")
+		}
+		if notReady != nil {
+			notReady()
+		}
+		time.Sleep(gatewayRetryInterval)
 	}
-
-	// Update VM status to be the onion address
-	v.updateVM(vmId, "complete", status)
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// How long a test waits for a job before giving up on it, the fake backend finishes them almost at once
+const testJobWait = 10 * time.Second
+
+// What the fake torcontrol says a VM's hostname is
+func testOnion(vmId string) string {
+	return fmt.Sprintf("vm%vtestonion.onion", vmId)
+}
+
+// Stands in for torcontrol on the pi, answering what createVM asks of it, with a hostname ready as soon as it's asked for
+type fakeTorcontrol struct{}
+
+func (fakeTorcontrol) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		fmt.Fprint(w, "invalid")
+		return w.Result(), nil
+	}
+	switch parts[0] {
+	case "create":
+		fmt.Fprint(w, "creating")
+	case "view":
+		fmt.Fprint(w, testOnion(parts[1]))
+	case "delete":
+		fmt.Fprint(w, "ok")
+	default:
+		fmt.Fprint(w, "invalid")
+	}
+	return w.Result(), nil
+}
+
+// The daemon as run() sets it up, but with the fake backend, everything kept in memory and a fake torcontrol, so it
+// runs without root, redis or the pi
+type testHypervisor struct {
+	t     *testing.T
+	v     *VMList
+	store *memoryStore
+	mux   *http.ServeMux
+}
+
+// The store is set up once and shared, as jobs can still be writing to it after the test that started them has seen
+// them finish, so nothing in it is cleared between tests
+var testSetup sync.Once
+var testStore = newMemoryStore()
+var testSetupErr error
+
+func newTestHypervisor(t *testing.T) *testHypervisor {
+	testSetup.Do(func() {
+		testSetupErr = loadPlans()
+		if testSetupErr != nil {
+			return
+		}
+		testSetupErr = loadImages()
+		if testSetupErr != nil {
+			return
+		}
+
+		controlKey = []byte("only for signing requests in tests, nothing else")
+		torcontrolClient = &http.Client{Transport: fakeTorcontrol{}}
+		store = testStore
+	})
+	if testSetupErr != nil {
+		t.Fatalf("loading plans and images: %v", testSetupErr)
+	}
+
+	backend = newFakeBackend()
+	v := &VMList{Vms: make(map[int]VMInformation)}
+	return &testHypervisor{t: t, v: v, store: testStore, mux: newMux(v)}
+}
+
+// Make a request signed the way the frontend signs them
+func (h *testHypervisor) request(method string, url string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	err := signRequest(r)
+	if err != nil {
+		h.t.Fatalf("signing %v %v: %v", method, url, err)
+	}
+	w := httptest.NewRecorder()
+	h.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Wait for a job to finish and return how it ended
+func (h *testHypervisor) waitForJob(id string) Job {
+	if id == "" {
+		h.t.Fatalf("no job ID")
+	}
+	deadline := time.Now().Add(testJobWait)
+	for time.Now().Before(deadline) {
+		w := h.request("GET", "/jobs/"+id)
+		if w.Code != http.StatusOK {
+			h.t.Fatalf("fetching job %v: %v %v", id, w.Code, w.Body.String())
+		}
+		var job Job
+		err := json.Unmarshal(w.Body.Bytes(), &job)
+		if err != nil {
+			h.t.Fatalf("decoding job %v: %v", id, err)
+		}
+		if job.Status != "running" {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.t.Fatalf("job %v still running after %v", id, testJobWait)
+	return Job{}
+}
+
+// Start a job with a request and wait for it to finish, failing the test unless both went fine
+func (h *testHypervisor) runJob(method string, url string, accepted string) Job {
+	w := h.request(method, url)
+	if w.Code != http.StatusOK || w.Body.String() != accepted {
+		h.t.Fatalf("%v %v: got %v %q, want %q", method, url, w.Code, w.Body.String(), accepted)
+	}
+	job := h.waitForJob(w.Header().Get("X-Job-Id"))
+	if job.Status != "done" {
+		h.t.Fatalf("%v %v: job %v %v: %v", method, url, job.Id, job.Status, job.Error)
+	}
+	return job
+}
+
+// What /view/N?format=json says about a VM, which has to agree with the registry
+func (h *testHypervisor) view(vmId int) VMInformation {
+	w := h.request("GET", fmt.Sprintf("/view/%v?format=json", vmId))
+	if w.Code != http.StatusOK {
+		h.t.Fatalf("viewing vm%v: %v %v", vmId, w.Code, w.Body.String())
+	}
+	var vm VMInformation
+	err := json.Unmarshal(w.Body.Bytes(), &vm)
+	if err != nil {
+		h.t.Fatalf("decoding vm%v: %v", vmId, err)
+	}
+	record, exists := h.store.vm(vmId)
+	if !exists {
+		h.t.Fatalf("vm%v has no record", vmId)
+	}
+	if record.Status != vm.Status || record.ShouldRun != vm.ShouldRun {
+		h.t.Fatalf("vm%v is %v (should run %v) but its record says %v (should run %v)", vmId, vm.Status, vm.ShouldRun, record.Status, record.ShouldRun)
+	}
+	return vm
+}
+
+// A VM's whole life, through the same handlers the frontend talks to
+func TestCreateSuspendResumeDelete(t *testing.T) {
+	h := newTestHypervisor(t)
+
+	// Create
+	h.runJob("GET", "/create/100?plan=small&image="+defaultImage, "creating")
+	w := h.request("GET", "/view/100")
+	if w.Body.String() != testOnion("100") {
+		t.Fatalf("after create: /view/100 says %q, want its hostname", w.Body.String())
+	}
+	if vm := h.view(100); vm.Status != "complete" || !vm.ShouldRun || vm.Plan != "small" {
+		t.Fatalf("after create: got %+v, want a complete small VM that should run", vm)
+	}
+
+	// It's already running
+	w = h.request("POST", "/vm/100/resume")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("resuming a running VM: got %v %q, want a conflict", w.Code, w.Body.String())
+	}
+
+	// Suspend
+	h.runJob("POST", "/vm/100/suspend", "suspending")
+	if vm := h.view(100); vm.Status != "suspended" || vm.ShouldRun {
+		t.Fatalf("after suspend: got %+v, want suspended and not meant to run", vm)
+	}
+	if state, err := backend.Inspect(100); err != nil || !state.Suspended {
+		t.Fatalf("after suspend: backend says %+v, %v", state, err)
+	}
+
+	// Resume
+	h.runJob("POST", "/vm/100/resume", "resuming")
+	if vm := h.view(100); vm.Status != "running" || !vm.ShouldRun {
+		t.Fatalf("after resume: got %+v, want running and meant to run", vm)
+	}
+
+	// Delete, which the frontend asks for on deletevm
+	acked := len(h.store.messages("vmdeleted"))
+	deleteVMMessage([]byte("100"), h.v)
+	w = h.request("GET", "/view/100")
+	if w.Body.String() != "invalid" {
+		t.Fatalf("after delete: /view/100 says %q, want invalid", w.Body.String())
+	}
+	if _, exists := h.store.vm(100); exists {
+		t.Fatalf("after delete: vm100 still has a record")
+	}
+	if guests := backend.List(); len(guests) != 0 {
+		t.Fatalf("after delete: the backend still has %+v", guests)
+	}
+
+	// The frontend waits for our acknowledgement, and finds the job through the VM
+	messages := h.store.messages("vmdeleted")[acked:]
+	if len(messages) != 1 {
+		t.Fatalf("after delete: published %v acknowledgements, want 1", len(messages))
+	}
+	var ack struct {
+		Id    int
+		Error string
+	}
+	err := json.Unmarshal(messages[0], &ack)
+	if err != nil || ack.Id != 100 || ack.Error != "" {
+		t.Fatalf("after delete: acknowledged %s, want vm100 without an error", messages[0])
+	}
+	job := h.waitForJob(h.store.latestJob(100))
+	if job.Kind != "delete" || job.Status != "done" {
+		t.Fatalf("after delete: latest job is %v %v, want a finished delete", job.Kind, job.Status)
+	}
+}
+
+// Only one job at a time on a VM
+func TestSuspendWhileBusy(t *testing.T) {
+	h := newTestHypervisor(t)
+	h.runJob("GET", "/create/101?plan=small&image="+defaultImage, "creating")
+
+	other := newJob("snapshot", 101, "create")
+	w := h.request("POST", "/vm/101/suspend")
+	if w.Code != http.StatusConflict || strings.TrimSpace(w.Body.String()) != "busy" {
+		t.Fatalf("suspending a busy VM: got %v %q, want busy", w.Code, w.Body.String())
+	}
+	other.finish(nil)
+
+	h.runJob("POST", "/vm/101/suspend", "suspending")
+}
+
+// Nothing happens without the frontend's signature
+func TestUnsignedRequest(t *testing.T) {
+	h := newTestHypervisor(t)
+
+	w := httptest.NewRecorder()
+	h.mux.ServeHTTP(w, httptest.NewRequest("GET", "/create/102", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unsigned create: got %v %q, want forbidden", w.Code, w.Body.String())
+	}
+	if _, exists := h.store.vm(102); exists {
+		t.Fatalf("unsigned create made a VM")
+	}
+}
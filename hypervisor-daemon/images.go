@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A base image a VM can be created from, and the kernel to boot it with
+type Image struct {
+	Id string
+	// What we call it on the create form
+	Name string
+	// In /root/vm-images, the VM's disk is a qcow2 overlay on top of it
+	BackingFile string
+	// In /root/vm-images/kernels, along with the initrd if it needs one
+	Kernel string
+	Initrd string
+	// The root= argument for the kernel
+	RootDevice string
+	// The sha256sum of the backing file, so we never hand out a disk built on a corrupted or swapped image
+	// Images without one aren't offered, except by the fake backend, which runs without the images or their sums
+	Checksum string
+}
+
+// Where the images are defined
+const imagesFile = "assets/images.json"
+
+// The image a VM gets if the request doesn't name one, which is what every VM got before there was a choice
+const defaultImage = "gentoo-vanilla-v3"
+
+// Every image, in the order they're listed in the file
+var images []Image
+
+var validImageId = regexp.MustCompile(`^[a-z0-9.-]{1,32}$`)
+
+// Backing files we've already checked, so we only hash each one once, keyed by path
+var verifiedImages = struct {
+	mux      sync.Mutex
+	verified map[string]os.FileInfo
+}{verified: make(map[string]os.FileInfo)}
+
+func loadImages() error {
+	buf, err := ioutil.ReadFile(imagesFile)
+	if err != nil {
+		return err
+	}
+
+	var loaded []Image
+	err = json.Unmarshal(buf, &loaded)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, img := range loaded {
+		if !validImageId.MatchString(img.Id) {
+			return fmt.Errorf("invalid image id %q", img.Id)
+		}
+		if seen[img.Id] {
+			return fmt.Errorf("image %v is defined twice", img.Id)
+		}
+		seen[img.Id] = true
+		// These end up in paths and on qemu's command line
+		for _, name := range []string{img.BackingFile, img.Kernel, img.Initrd} {
+			if strings.ContainsAny(name, "/,") {
+				return fmt.Errorf("image %v: %q must be a plain file name", img.Id, name)
+			}
+		}
+		if img.BackingFile == "" || img.Kernel == "" || img.RootDevice == "" {
+			return fmt.Errorf("image %v needs a backing file, kernel and root device", img.Id)
+		}
+		if strings.ContainsAny(img.RootDevice, " \t\"") {
+			return fmt.Errorf("image %v: root device %q would split the kernel command line", img.Id, img.RootDevice)
+		}
+		// A missing one is only a problem once we use the image, but one that's there has to make sense
+		if img.Checksum == "" {
+			fmt.Fprintf(os.Stderr, "image %v has no checksum, VMs can't be created from it until it has\n", img.Id)
+		} else if !img.validChecksum() {
+			return fmt.Errorf("image %v has an invalid checksum, set it to the output of sha256sum /root/vm-images/%v", img.Id, img.BackingFile)
+		}
+	}
+	if !seen[defaultImage] {
+		return errors.New("the default image " + defaultImage + " is not defined")
+	}
+
+	images = loaded
+	return nil
+}
+
+func findImage(id string) (Image, bool) {
+	for _, img := range images {
+		if img.Id == id {
+			return img, true
+		}
+	}
+	return Image{}, false
+}
+
+func (img Image) backingPath() string {
+	return filepath.Join("/root/vm-images", img.BackingFile)
+}
+
+func (img Image) kernelPath() string {
+	return filepath.Join("/root/vm-images/kernels", img.Kernel)
+}
+
+// The VM's own disk, an overlay on the image's backing file
+func (img Image) diskPath(vmId int) string {
+	return fmt.Sprintf("%v/vm%v-%v.img", vmDir(vmId), vmId, img.Id)
+}
+
+func (img Image) initrdPath() string {
+	return filepath.Join("/root/vm-images/kernels", img.Initrd)
+}
+
+// Whether Checksum looks like a sha256sum
+func (img Image) validChecksum() bool {
+	checksum, err := hex.DecodeString(img.Checksum)
+	return err == nil && len(checksum) == sha256.Size
+}
+
+// Whether VMs can be created from it, the fake backend never reads the backing file so it doesn't need a checksum
+func (img Image) usable() bool {
+	if _, fake := backend.(*fakeBackend); fake {
+		return true
+	}
+	return img.validChecksum()
+}
+
+// The images VMs can be created from right now
+func usableImages() []Image {
+	usable := []Image{}
+	for _, img := range images {
+		if img.usable() {
+			usable = append(usable, img)
+		}
+	}
+	return usable
+}
+
+// Refuse to start if there's nothing to create VMs from, rather than failing every create at the disk step
+func checkImages() error {
+	if len(usableImages()) == 0 {
+		return fmt.Errorf("none of the images in %v have a checksum, add them with the output of sha256sum", imagesFile)
+	}
+	return nil
+}
+
+// Check the backing file is the one the catalog says it is
+// Hashing a whole image takes a while, so we only do it again if the file has changed since
+func (img Image) verify() error {
+	if !img.validChecksum() {
+		return fmt.Errorf("image %v has no valid checksum, set it to the output of sha256sum /root/vm-images/%v", img.Id, img.BackingFile)
+	}
+	path := img.backingPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	verifiedImages.mux.Lock()
+	defer verifiedImages.mux.Unlock()
+
+	if old, ok := verifiedImages.verified[path]; ok && old.Size() == info.Size() && old.ModTime().Equal(info.ModTime()) {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != strings.ToLower(img.Checksum) {
+		return fmt.Errorf("%v has checksum %v, expected %v", path, sum, img.Checksum)
+	}
+
+	verifiedImages.verified[path] = info
+	return nil
+}
+
+// List the images VMs can be created from, for the frontend to offer
+func imagesHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+	b, err := json.Marshal(usableImages())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error json encoding our images: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
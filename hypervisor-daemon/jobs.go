@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Anything that changes a VM and takes more than a moment is a job: creating, repairing, deleting, suspending and
+// resuming VMs, and snapshots
+// A job has an ID the caller gets back in X-Job-Id, and a fixed list of steps that are ticked off as it goes, so when
+// something breaks /jobs/ID says exactly which step it was and why. Jobs are kept in memory and written through to
+// redis, which expires them after jobRetention, so they outlive a restart of the daemon. The latest job on each VM is
+// also kept in vm:N:job, which is how the frontend finds jobs it only started over pubsub, e.g. deletes.
+
+// How long finished jobs are kept
+const jobRetention = 7 * 24 * time.Hour
+
+// The steps of each kind of job, in order
+var createSteps = []string{"disk", "vlan", "bridge", "qemu", "tor", "hostname"}
+var deleteSteps = []string{"qemu", "network", "disk"}
+
+type JobStep struct {
+	Name string
+	// pending, running, done or failed
+	Status string
+	// Zero until the step starts and finishes
+	Started  time.Time
+	Finished time.Time
+	Error    string `json:",omitempty"`
+}
+
+type Job struct {
+	Id   string
+	Kind string
+	VmId int
+	// running, done or failed
+	Status   string
+	Steps    []JobStep
+	Error    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+}
+
+// A job we're running or ran since we started
+type trackedJob struct {
+	mux sync.Mutex
+	Job
+}
+
+var jobs = struct {
+	mux  sync.Mutex
+	jobs map[string]*trackedJob
+	// The job each VM has running, so code deep in a backend can report its progress
+	running map[int]*trackedJob
+}{jobs: make(map[string]*trackedJob), running: make(map[int]*trackedJob)}
+
+// Start a job with the given steps, all pending
+func newJob(kind string, vmId int, steps ...string) *trackedJob {
+	return addJob(kind, vmId, false, steps)
+}
+
+// Start a job like newJob, unless the VM already has one running, in which case it returns nil
+// Checking and starting it at once means two requests at the same time can't both get in
+func newJobIfIdle(kind string, vmId int, steps ...string) *trackedJob {
+	return addJob(kind, vmId, true, steps)
+}
+
+func addJob(kind string, vmId int, onlyIfIdle bool, steps []string) *trackedJob {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		// Not being able to get randomness means much bigger problems than a clashing ID
+		panic(err)
+	}
+
+	j := &trackedJob{Job: Job{Id: hex.EncodeToString(buf), Kind: kind, VmId: vmId, Status: "running", Started: time.Now()}}
+	for _, step := range steps {
+		j.Steps = append(j.Steps, JobStep{Name: step, Status: "pending"})
+	}
+
+	jobs.mux.Lock()
+	if onlyIfIdle && jobs.running[vmId] != nil {
+		jobs.mux.Unlock()
+		return nil
+	}
+	pruneJobs()
+	jobs.jobs[j.Id] = j
+	jobs.running[vmId] = j
+	jobs.mux.Unlock()
+
+	fmt.Println(fmt.Sprintf("[%v] Job %v: %v of vm%v", time.Now(), j.Id, kind, vmId))
+	j.save()
+	j.saveLatest()
+	return j
+}
+
+// Record this as the VM's latest job
+func (j *trackedJob) saveLatest() {
+	err := store.SaveLatestJob(j.VmId, j.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving the latest job of vm%v: %v\n", j.VmId, err)
+	}
+}
+
+// Forget finished jobs past their retention, redis has already expired them, the caller must hold jobs.mux
+func pruneJobs() {
+	for id, j := range jobs.jobs {
+		j.mux.Lock()
+		expired := j.Status != "running" && time.Since(j.Finished) > jobRetention
+		j.mux.Unlock()
+		if expired {
+			delete(jobs.jobs, id)
+		}
+	}
+}
+
+// Move on to the named step, anything before it still outstanding was done along the way
+func (j *trackedJob) step(name string) {
+	j.mux.Lock()
+	now := time.Now()
+	for i := range j.Steps {
+		s := &j.Steps[i]
+		if s.Name == name {
+			s.Status = "running"
+			s.Started = now
+			break
+		}
+		if s.Status == "pending" || s.Status == "running" {
+			if s.Started.IsZero() {
+				s.Started = now
+			}
+			s.Status = "done"
+			s.Finished = now
+		}
+	}
+	j.mux.Unlock()
+
+	j.save()
+}
+
+// Fail the step we're on without ending the job, for jobs that carry on past a failure
+func (j *trackedJob) stepFailed(err error) {
+	j.mux.Lock()
+	for i := range j.Steps {
+		s := &j.Steps[i]
+		if s.Status == "running" {
+			s.Status = "failed"
+			s.Finished = time.Now()
+			s.Error = err.Error()
+		}
+	}
+	j.mux.Unlock()
+
+	j.save()
+}
+
+// Finish the job, failing the step it was on if err isn't nil, unless we carried on past a step that already failed,
+// in which case that's the reason and the step we're on went fine
+func (j *trackedJob) finish(err error) {
+	j.mux.Lock()
+	now := time.Now()
+	j.Finished = now
+	if err == nil {
+		j.Status = "done"
+		for i := range j.Steps {
+			s := &j.Steps[i]
+			if s.Status == "pending" || s.Status == "running" {
+				if s.Started.IsZero() {
+					s.Started = now
+				}
+				s.Status = "done"
+				s.Finished = now
+			}
+		}
+	} else {
+		j.Status = "failed"
+		j.Error = err.Error()
+		failed := false
+		for _, s := range j.Steps {
+			if s.Status == "failed" {
+				failed = true
+			}
+		}
+		for i := range j.Steps {
+			s := &j.Steps[i]
+			if s.Status == "running" && failed {
+				s.Status = "done"
+				s.Finished = now
+			} else if s.Status == "running" {
+				s.Status = "failed"
+				s.Finished = now
+				s.Error = err.Error()
+			}
+		}
+	}
+	fmt.Println(fmt.Sprintf("[%v] Job %v: %v", time.Now(), j.Id, j.Status))
+	j.mux.Unlock()
+
+	jobs.mux.Lock()
+	if jobs.running[j.VmId] == j {
+		delete(jobs.running, j.VmId)
+	}
+	jobs.mux.Unlock()
+
+	j.save()
+}
+
+// Report progress on whatever job a VM has running, if any
+func jobStep(vmId int, name string) {
+	jobs.mux.Lock()
+	j := jobs.running[vmId]
+	jobs.mux.Unlock()
+	if j != nil {
+		j.step(name)
+	}
+}
+
+// Write the job through to the store, losing track of it there only costs us its history
+func (j *trackedJob) save() {
+	j.mux.Lock()
+	job := j.copy()
+	j.mux.Unlock()
+
+	err := store.SaveJob(job)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving job %v: %v\n", j.Id, err)
+	}
+}
+
+// A job by ID, from memory or, if we've restarted since, the store
+func findJob(id string) (Job, bool, error) {
+	jobs.mux.Lock()
+	j, exists := jobs.jobs[id]
+	jobs.mux.Unlock()
+	if exists {
+		j.mux.Lock()
+		defer j.mux.Unlock()
+		return j.copy(), true, nil
+	}
+
+	job, exists, err := store.FindJob(id)
+	if err != nil || !exists {
+		return Job{}, exists, err
+	}
+	// It was cut short by us stopping, nothing is carrying on with it
+	if job.Status == "running" {
+		job.Status = "failed"
+		job.Error = "hypervisor-daemon stopped while it was running"
+	}
+	return job, true, nil
+}
+
+// A copy safe to hand out, the caller must hold j.mux
+func (j *trackedJob) copy() Job {
+	c := j.Job
+	c.Steps = append([]JobStep{}, j.Steps...)
+	return c
+}
+
+// A job, e.g. /jobs/0123456789abcdef, or the jobs for a VM since we started, e.g. /jobs/?vm=100
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var out interface{}
+	id := r.URL.Path[len("/jobs/"):]
+	if id != "" {
+		job, exists, err := findJob(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error finding job %v: %v\n", id, err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "unknown", http.StatusNotFound)
+			return
+		}
+		out = job
+	} else {
+		vmId, err := strconv.Atoi(r.URL.Query().Get("vm"))
+		if err != nil {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		list := []Job{}
+		jobs.mux.Lock()
+		for _, j := range jobs.jobs {
+			j.mux.Lock()
+			if j.VmId == vmId {
+				list = append(list, j.copy())
+			}
+			j.mux.Unlock()
+		}
+		jobs.mux.Unlock()
+		sort.Slice(list, func(a, b int) bool {
+			return list[a].Started.Before(list[b].Started)
+		})
+		out = list
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error json encoding jobs: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
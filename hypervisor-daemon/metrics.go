@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Prometheus metrics for the host and every VM on it, in the text exposition format
+// They're served on their own listener (-metrics), which only lets in certificates for the prometheus role, so the
+// scraper never gets near the endpoints that change anything. See docs/metrics.md for what's there.
+
+// The kernel reports process CPU time in these, it's 100 on every platform we run on
+const clockTicks = 100
+
+// How long creating and deleting VMs takes, by whether it worked
+var createDuration = newHistogram([]float64{5, 10, 20, 30, 60, 120, 300, 600})
+var deleteDuration = newHistogram([]float64{1, 2, 5, 10, 30, 60, 120})
+
+// A Prometheus histogram, with one series per result
+type histogram struct {
+	mux     sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(result string, d time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s, exists := h.series[result]
+	if !exists {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[result] = s
+	}
+	seconds := d.Seconds()
+	for i, le := range h.buckets {
+		if seconds <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+func (h *histogram) write(m *metricWriter, name string, help string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	m.help(name, "histogram", help)
+	var results []string
+	for result := range h.series {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		s := h.series[result]
+		for i, le := range h.buckets {
+			m.sample(name+"_bucket", float64(s.counts[i]), "result", result, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		m.sample(name+"_bucket", float64(s.count), "result", result, "le", "+Inf")
+		m.sample(name+"_sum", s.sum, "result", result)
+		m.sample(name+"_count", float64(s.count), "result", result)
+	}
+}
+
+// Builds up the text format
+type metricWriter struct {
+	buf bytes.Buffer
+}
+
+func (m *metricWriter) help(name string, kind string, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// A sample, with labels given as name, value pairs
+func (m *metricWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteString(",")
+			}
+			fmt.Fprintf(&m.buf, "%v=%v", labels[i], strconv.Quote(labels[i+1]))
+		}
+		m.buf.WriteString("}")
+	}
+	fmt.Fprintf(&m.buf, " %v\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// CPU seconds and resident bytes of a process, from /proc/PID/stat and /proc/PID/statm
+func processUsage(pid int) (float64, int64, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name can contain spaces, so count fields from after it, utime and stime are the 12th and 13th
+	end := bytes.LastIndexByte(stat, ')')
+	if end == -1 {
+		return 0, 0, errors.New("malformed stat")
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 13 {
+		return 0, 0, errors.New("malformed stat")
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	statm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/statm", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	pages := strings.Fields(string(statm))
+	if len(pages) < 2 {
+		return 0, 0, errors.New("malformed statm")
+	}
+	resident, err := strconv.ParseInt(pages[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return float64(utime+stime) / clockTicks, resident * int64(os.Getpagesize()), nil
+}
+
+// The space a file takes up on disk, which for a qcow2 overlay is how much the guest has written
+func allocatedSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size(), nil
+	}
+	// st_blocks is always in 512 byte units
+	return stat.Blocks * 512, nil
+}
+
+// The size of the disk the guest sees, from the qcow2 header, which is cheaper than asking qemu-img
+func qcow2Size(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// The magic, version, backing file offset and size, cluster bits, then the size
+	header := make([]byte, 32)
+	_, err = f.ReadAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != "QFI\xfb" {
+		return 0, fmt.Errorf("%v is not a qcow2 image", path)
+	}
+	return int64(binary.BigEndian.Uint64(header[24:32])), nil
+}
+
+// Byte counters of a VM's bridge and everything on it, i.e. its vlan and the guest's tap
+func interfaceCounters(vmId int) map[string][2]uint64 {
+	counters := make(map[string][2]uint64)
+	names := []string{bridgeName(vmId)}
+	members, _ := filepath.Glob(fmt.Sprintf("/sys/class/net/%v/brif/*", bridgeName(vmId)))
+	for _, member := range members {
+		names = append(names, filepath.Base(member))
+	}
+
+	for _, name := range names {
+		var c [2]uint64
+		for i, counter := range []string{"rx_bytes", "tx_bytes"} {
+			buf, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%v/statistics/%v", name, counter))
+			if err != nil {
+				break
+			}
+			c[i], _ = strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+		}
+		counters[name] = c
+	}
+	return counters
+}
+
+// The host's CPU time by mode, from the first line of /proc/stat
+func hostCPU() (map[string]float64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, errors.New("empty /proc/stat")
+	}
+	fields := strings.Fields(scanner.Text())
+	modes := []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+	if len(fields) < len(modes)+1 || fields[0] != "cpu" {
+		return nil, errors.New("malformed /proc/stat")
+	}
+
+	cpu := make(map[string]float64)
+	for i, mode := range modes {
+		ticks, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cpu[mode] = float64(ticks) / clockTicks
+	}
+	return cpu, nil
+}
+
+// MemTotal and MemAvailable from /proc/meminfo, in bytes
+func hostMemory() (int64, int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var total, available int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kib, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kib * 1024
+		case "MemAvailable:":
+			available = kib * 1024
+		}
+	}
+	return total, available, scanner.Err()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request, v *VMList) {
+	m := &metricWriter{}
+
+	// A copy, so we aren't holding the lock while reading /proc
+	v.mux.Lock()
+	vms := make(map[int]VMInformation)
+	for id, vm := range v.Vms {
+		vms[id] = vm
+	}
+	v.mux.Unlock()
+	var ids []int
+	for id := range vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	statuses := make(map[string]int)
+	for _, vm := range vms {
+		statuses[vm.Status]++
+	}
+	m.help("hypervisor_vms", "gauge", "VMs by status.")
+	var names []string
+	for status := range statuses {
+		names = append(names, status)
+	}
+	sort.Strings(names)
+	for _, status := range names {
+		m.sample("hypervisor_vms", float64(statuses[status]), "status", status)
+	}
+
+	usage := make(map[int]GuestUsage)
+	for _, id := range ids {
+		u, err := backend.Usage(id)
+		if err != nil {
+			// A VM being created or deleted may have no disk, so just leave it out
+			continue
+		}
+		usage[id] = u
+	}
+
+	m.help("hypervisor_vm_up", "gauge", "Whether the VM's qemu process is running.")
+	for _, id := range ids {
+		if u, ok := usage[id]; ok {
+			up := 0.0
+			if u.Running {
+				up = 1
+			}
+			m.sample("hypervisor_vm_up", up, "vm", strconv.Itoa(id), "plan", vms[id].Plan)
+		}
+	}
+	m.help("hypervisor_vm_cpu_seconds_total", "counter", "CPU time used by the VM's qemu process. Resets when the process is restarted.")
+	for _, id := range ids {
+		if u, ok := usage[id]; ok && u.Running {
+			m.sample("hypervisor_vm_cpu_seconds_total", u.CPUSeconds, "vm", strconv.Itoa(id), "plan", vms[id].Plan)
+		}
+	}
+	m.help("hypervisor_vm_memory_rss_bytes", "gauge", "Resident memory of the VM's qemu process.")
+	for _, id := range ids {
+		if u, ok := usage[id]; ok && u.Running {
+			m.sample("hypervisor_vm_memory_rss_bytes", float64(u.RSSBytes), "vm", strconv.Itoa(id), "plan", vms[id].Plan)
+		}
+	}
+	m.help("hypervisor_vm_disk_allocated_bytes", "gauge", "Space the VM's qcow2 overlay takes up on the host.")
+	for _, id := range ids {
+		if u, ok := usage[id]; ok {
+			m.sample("hypervisor_vm_disk_allocated_bytes", float64(u.DiskAllocatedBytes), "vm", strconv.Itoa(id), "plan", vms[id].Plan)
+		}
+	}
+	m.help("hypervisor_vm_disk_size_bytes", "gauge", "Size of the disk the VM sees.")
+	for _, id := range ids {
+		if u, ok := usage[id]; ok {
+			m.sample("hypervisor_vm_disk_size_bytes", float64(u.DiskSizeBytes), "vm", strconv.Itoa(id), "plan", vms[id].Plan)
+		}
+	}
+
+	// Host side counters, so the bridge's receive is what the VM sent and the tap's receive is what it was sent
+	counters := make(map[int]map[string][2]uint64)
+	for _, id := range ids {
+		counters[id] = interfaceCounters(id)
+	}
+	for i, direction := range []struct{ name, verb string }{{"receive", "received"}, {"transmit", "transmitted"}} {
+		name := fmt.Sprintf("hypervisor_vm_network_%v_bytes_total", direction.name)
+		m.help(name, "counter", fmt.Sprintf("Bytes %v on the host side of the VM's bridge, vlan and tap.", direction.verb))
+		for _, id := range ids {
+			var interfaces []string
+			for name := range counters[id] {
+				interfaces = append(interfaces, name)
+			}
+			sort.Strings(interfaces)
+			for _, iface := range interfaces {
+				m.sample(name, float64(counters[id][iface][i]), "vm", strconv.Itoa(id), "interface", iface)
+			}
+		}
+	}
+
+	// Host totals, for seeing how much room is left
+	cpu, err := hostCPU()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading host cpu: %v\n", err)
+	} else {
+		m.help("hypervisor_host_cpu_seconds_total", "counter", "CPU time of the host across all CPUs, by mode.")
+		var modes []string
+		for mode := range cpu {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+		for _, mode := range modes {
+			m.sample("hypervisor_host_cpu_seconds_total", cpu[mode], "mode", mode)
+		}
+	}
+
+	total, available, err := hostMemory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading host memory: %v\n", err)
+	} else {
+		m.help("hypervisor_host_memory_total_bytes", "gauge", "Memory in the host.")
+		m.sample("hypervisor_host_memory_total_bytes", float64(total))
+		m.help("hypervisor_host_memory_available_bytes", "gauge", "Memory the host could give out without swapping.")
+		m.sample("hypervisor_host_memory_available_bytes", float64(available))
+	}
+
+	var fs syscall.Statfs_t
+	err = syscall.Statfs(filepath.Dir(vmDir(0)), &fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading disk space: %v\n", err)
+	} else {
+		m.help("hypervisor_host_disk_size_bytes", "gauge", "Size of the filesystem VM disks are on.")
+		m.sample("hypervisor_host_disk_size_bytes", float64(fs.Blocks*uint64(fs.Bsize)))
+		m.help("hypervisor_host_disk_available_bytes", "gauge", "Space left on the filesystem VM disks are on.")
+		m.sample("hypervisor_host_disk_available_bytes", float64(fs.Bavail*uint64(fs.Bsize)))
+	}
+
+	createDuration.write(m, "hypervisor_vm_create_duration_seconds", "How long creating a VM took, until it had an onion address or broke. Only counts creates since hypervisor-daemon started, so it resets when it restarts.")
+	deleteDuration.write(m, "hypervisor_vm_delete_duration_seconds", "How long deleting a VM took. Only counts deletes since hypervisor-daemon started, so it resets when it restarts.")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.buf.Bytes())
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Setting up VM networks directly over netlink, rather than through OpenRC's scripts
+// The VMs that should have a network are kept in our own state file, and we rebuild their links from it when we start,
+// so nothing about them depends on OpenRC. OpenRC still looks after enp3s0 itself, from the static part of assets/net.
+//
+// To move a host over from OpenRC, stop the daemon, run rc-update del and remove /etc/init.d/net.brN for every VM,
+// write their IDs to the state file as {"Vms": [100, 101]}, then start the daemon with -network netlink.
+
+// Where we keep the VMs that should have a network
+const netlinkStateFile = "/var/lib/hypervisor-daemon/network.json"
+
+// The interface every VM's vlan hangs off
+const uplinkInterface = "enp3s0"
+
+type netlinkNetwork struct {
+	stateFile string
+}
+
+type netlinkState struct {
+	Vms []int
+}
+
+// The caller must hold hostNetwork
+func (n *netlinkNetwork) load() (map[int]bool, error) {
+	vms := make(map[int]bool)
+	buf, err := ioutil.ReadFile(n.stateFile)
+	if os.IsNotExist(err) {
+		return vms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state netlinkState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", n.stateFile, err)
+	}
+	for _, vmId := range state.Vms {
+		vms[vmId] = true
+	}
+	return vms, nil
+}
+
+// Write the state atomically, the same way as /etc/conf.d/net
+// The caller must hold hostNetwork
+func (n *netlinkNetwork) save(vms map[int]bool) error {
+	state := netlinkState{Vms: []int{}}
+	for vmId := range vms {
+		state.Vms = append(state.Vms, vmId)
+	}
+	sort.Ints(state.Vms)
+
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(n.stateFile), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := n.stateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, n.stateFile)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func vlanName(vmId int) string {
+	return fmt.Sprintf("%v.%v", uplinkInterface, vmId)
+}
+
+func bridgeName(vmId int) string {
+	return fmt.Sprintf("br%v", vmId)
+}
+
+// Bring up a VM's vlan and bridge, leaving alone whatever already exists, so it's safe to run again at startup
+// Returns what it created, so a failed Attach can remove exactly that
+func (n *netlinkNetwork) ensure(vmId int) (created []netlink.Link, err error) {
+	uplink, err := netlink.LinkByName(uplinkInterface)
+	if err != nil {
+		return nil, fmt.Errorf("finding %v: %v", uplinkInterface, err)
+	}
+
+	// The vlan, tagged with the VM's ID like on the switch and the pi
+	vlan, err := netlink.LinkByName(vlanName(vmId))
+	if err != nil {
+		vlan = &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: vlanName(vmId), ParentIndex: uplink.Attrs().Index}, VlanId: vmId}
+		err = netlink.LinkAdd(vlan)
+		if err != nil {
+			return created, fmt.Errorf("adding vlan: %v", err)
+		}
+		created = append(created, vlan)
+	}
+
+	// The bridge qemu-bridge-helper attaches the guest's tap to
+	jobStep(vmId, "bridge")
+	bridge, err := netlink.LinkByName(bridgeName(vmId))
+	if err != nil {
+		bridge = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName(vmId)}}
+		err = netlink.LinkAdd(bridge)
+		if err != nil {
+			return created, fmt.Errorf("adding bridge: %v", err)
+		}
+		created = append(created, bridge)
+	}
+
+	// The same as brctl setfd 0, sethello 10 and stp off in assets/net, the kernel takes these in hundredths of a second
+	for file, value := range map[string]string{"forward_delay": "0", "hello_time": "1000", "stp_state": "0"} {
+		err = ioutil.WriteFile(fmt.Sprintf("/sys/class/net/%v/bridge/%v", bridgeName(vmId), file), []byte(value), 0644)
+		if err != nil {
+			return created, fmt.Errorf("setting bridge %v: %v", file, err)
+		}
+	}
+
+	err = netlink.LinkSetMaster(vlan, bridge)
+	if err != nil {
+		return created, fmt.Errorf("adding vlan to bridge: %v", err)
+	}
+
+	addr, err := netlink.ParseAddr(fmt.Sprintf("10.0.%v.20/24", vmId))
+	if err != nil {
+		return created, err
+	}
+	err = netlink.AddrAdd(bridge, addr)
+	if err != nil && err != syscall.EEXIST {
+		return created, fmt.Errorf("adding address to bridge: %v", err)
+	}
+
+	err = netlink.LinkSetUp(vlan)
+	if err != nil {
+		return created, fmt.Errorf("bringing up vlan: %v", err)
+	}
+	err = netlink.LinkSetUp(bridge)
+	if err != nil {
+		return created, fmt.Errorf("bringing up bridge: %v", err)
+	}
+
+	return created, nil
+}
+
+// Remove a link by name, not minding if it's already gone
+func removeLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func (n *netlinkNetwork) Attach(vmId int) error {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	vms, err := n.load()
+	if err != nil {
+		return err
+	}
+	if vms[vmId] {
+		return fmt.Errorf("vm%v already has a bridge", vmId)
+	}
+
+	created, err := n.ensure(vmId)
+	if err == nil {
+		// Only once it all exists is it part of the state we restore
+		vms[vmId] = true
+		err = n.save(vms)
+	}
+	if err != nil {
+		for i := len(created) - 1; i >= 0; i-- {
+			undoErr := netlink.LinkDel(created[i])
+			if undoErr != nil {
+				fmt.Fprintf(os.Stderr, "error rolling back %v for vm%v: %v\n", created[i].Attrs().Name, vmId, undoErr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (n *netlinkNetwork) Inspect(vmId int) (NetworkState, error) {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	vms, err := n.load()
+	if err != nil {
+		return NetworkState{}, err
+	}
+	return NetworkState{Recorded: vms[vmId], Vlan: linkExists(vlanName(vmId)), Bridge: linkExists(bridgeName(vmId))}, nil
+}
+
+func (n *netlinkNetwork) Detach(vmId int) error {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	vms, err := n.load()
+	if err != nil {
+		return err
+	}
+
+	// Deleting the bridge releases the vlan from it
+	err = removeLink(bridgeName(vmId))
+	if err != nil {
+		return fmt.Errorf("removing bridge: %v", err)
+	}
+	err = removeLink(vlanName(vmId))
+	if err != nil {
+		return fmt.Errorf("removing vlan: %v", err)
+	}
+
+	delete(vms, vmId)
+	return n.save(vms)
+}
+
+// Recreate every VM's links after the host reboots, and keep OpenRC out of them
+func (n *netlinkNetwork) Restore() error {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	// OpenRC only gets the static configuration for enp3s0
+	err := writeNetConfig(map[int]bool{})
+	if err != nil {
+		return err
+	}
+
+	vms, err := n.load()
+	if err != nil {
+		return err
+	}
+	for vmId := range vms {
+		_, err = n.ensure(vmId)
+		if err != nil {
+			// Carry on with the rest, one broken VM shouldn't take every other one down with it
+			fmt.Fprintf(os.Stderr, "error restoring network for vm%v: %v\n", vmId, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// The host side of a VM's network is a vlan on enp3s0 and a bridge on top of it, with 10.0.N.20 on the bridge
+// There are two ways of setting that up, through OpenRC's scripts and config, or directly over netlink (see
+// network-netlink.go), picked with -network
+
+type HostNetwork interface {
+	// Set up a VM's vlan and bridge, leaving nothing behind if any step fails
+	Attach(vmId int) error
+	// Tear them down again
+	Detach(vmId int) error
+	// Make sure everything that should exist does, when we start
+	Restore() error
+	// Which parts of a VM's network exist
+	Inspect(vmId int) (NetworkState, error)
+}
+
+type NetworkState struct {
+	// Whether it's part of the configuration we restore on boot
+	Recorded bool
+	Vlan     bool
+	Bridge   bool
+}
+
+// Whether the network is all there
+func (n NetworkState) complete() bool {
+	return n.Recorded && n.Vlan && n.Bridge
+}
+
+// Whether a network interface exists
+func linkExists(name string) bool {
+	_, err := os.Stat("/sys/class/net/" + name)
+	return err == nil
+}
+
+// The implementation in use
+var network HostNetwork
+
+func newHostNetwork(name string) (HostNetwork, error) {
+	switch name {
+	case "openrc":
+		return &openrcNetwork{}, nil
+	case "netlink":
+		return &netlinkNetwork{stateFile: netlinkStateFile}, nil
+	}
+	return nil, fmt.Errorf("unknown network %q, expected openrc or netlink", name)
+}
+
+// With OpenRC, changes are made as a transaction. /etc/conf.d/net is only ever rendered from the VMs whose network is
+// fully set up, and if any step of setting one up fails, every step before it is undone, so a half made VM never ends
+// up in the config to trip up the next reboot.
+
+// Where OpenRC reads the network config from
+const netConfigFile = "/etc/conf.d/net"
+
+// Only one change to the host network at a time, as each one rewrites the whole config
+var hostNetwork sync.Mutex
+
+type openrcNetwork struct{}
+
+// The VMs whose network is set up, which are the ones with a bridge init script
+// The caller must hold hostNetwork
+func committedNetworks() (map[int]bool, error) {
+	scripts, err := filepath.Glob("/etc/init.d/net.br*")
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make(map[int]bool)
+	for _, script := range scripts {
+		vmId, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(script), "net.br"))
+		if err != nil {
+			continue
+		}
+		vms[vmId] = true
+	}
+	return vms, nil
+}
+
+// Render assets/net for the given VMs and atomically replace /etc/conf.d/net with it
+// The caller must hold hostNetwork
+func writeNetConfig(vms map[int]bool) error {
+	t, err := template.ParseFiles("assets/net")
+	if err != nil {
+		return fmt.Errorf("parsing net template: %v", err)
+	}
+	var net bytes.Buffer
+	err = t.Execute(&net, struct{ Vms map[int]bool }{vms})
+	if err != nil {
+		return fmt.Errorf("executing net template: %v", err)
+	}
+
+	// Write it next to the real one and rename it over, so a crash never leaves OpenRC half a file
+	tmp := filepath.Join(filepath.Dir(netConfigFile), ".net.tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("writing %v: %v", tmp, err)
+	}
+	_, err = f.Write(net.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %v: %v", tmp, err)
+	}
+
+	err = os.Rename(tmp, netConfigFile)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replacing %v: %v", netConfigFile, err)
+	}
+
+	return nil
+}
+
+// Write the config for exactly the VMs whose network is set up
+// The caller must hold hostNetwork
+func regenerateNetConfig() error {
+	vms, err := committedNetworks()
+	if err != nil {
+		return err
+	}
+	return writeNetConfig(vms)
+}
+
+// OpenRC brings the bridges back on boot by itself, all we do is clean up after any VM deleted before the config
+// was regenerated on delete
+func (o *openrcNetwork) Restore() error {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	return regenerateNetConfig()
+}
+
+func (o *openrcNetwork) Inspect(vmId int) (NetworkState, error) {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	vms, err := committedNetworks()
+	if err != nil {
+		return NetworkState{}, err
+	}
+	return NetworkState{Recorded: vms[vmId], Vlan: linkExists(vlanName(vmId)), Bridge: linkExists(bridgeName(vmId))}, nil
+}
+
+// Set up the vlan and bridge for a VM, undoing everything if any step fails
+func (o *openrcNetwork) Attach(vmId int) (err error) {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	vms, err := committedNetworks()
+	if err != nil {
+		return err
+	}
+	if vms[vmId] {
+		return fmt.Errorf("vm%v already has a bridge", vmId)
+	}
+
+	// Everything done so far, undone in reverse if we fail part way
+	var undo []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
+
+	// The config has to know about the new bridge before OpenRC can start it
+	vms[vmId] = true
+	err = writeNetConfig(vms)
+	if err != nil {
+		return err
+	}
+	undo = append(undo, func() {
+		delete(vms, vmId)
+		undoErr := writeNetConfig(vms)
+		if undoErr != nil {
+			fmt.Fprintf(os.Stderr, "error rolling back %v for vm%v: %v\n", netConfigFile, vmId, undoErr)
+		}
+	})
+
+	// Create the symlink for the bridge
+	script := fmt.Sprintf("/etc/init.d/net.br%v", vmId)
+	err = os.Symlink("/etc/init.d/net.bridge", script)
+	if err != nil {
+		return fmt.Errorf("creating bridge symlink: %v", err)
+	}
+	undo = append(undo, func() {
+		undoErr := os.Remove(script)
+		if undoErr != nil {
+			fmt.Fprintf(os.Stderr, "error rolling back bridge symlink for vm%v: %v\n", vmId, undoErr)
+		}
+	})
+
+	// Manually bring up the new vlan
+	out, err := exec.Command("ip", "link", "add", "link", "enp3s0", "name", fmt.Sprintf("enp3s0.%v", vmId), "type", "vlan", "id", fmt.Sprintf("%v", vmId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("adding vlan: %v %s", err, out)
+	}
+	undo = append(undo, func() {
+		out, undoErr := exec.Command("ip", "link", "del", fmt.Sprintf("enp3s0.%v", vmId)).CombinedOutput()
+		if undoErr != nil {
+			fmt.Fprintf(os.Stderr, "error rolling back vlan for vm%v: %v %s\n", vmId, undoErr, out)
+		}
+	})
+
+	// Activate the new bridge
+	jobStep(vmId, "bridge")
+	out, err = exec.Command(script, "start").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("starting bridge: %v %s", err, out)
+	}
+	undo = append(undo, func() {
+		out, undoErr := exec.Command(script, "stop").CombinedOutput()
+		if undoErr != nil {
+			fmt.Fprintf(os.Stderr, "error rolling back bridge for vm%v: %v %s\n", vmId, undoErr, out)
+		}
+	})
+
+	// Configure the bridge to start on boot
+	out, err = exec.Command("rc-update", "add", fmt.Sprintf("net.br%v", vmId), "default").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("adding bridge to default runlevel: %v %s", err, out)
+	}
+
+	return nil
+}
+
+// Tear down a VM's vlan and bridge, and take it out of the config
+// Anything already missing is skipped, so this also cleans up after a VM that was only half set up
+func (o *openrcNetwork) Detach(vmId int) error {
+	hostNetwork.Lock()
+	defer hostNetwork.Unlock()
+
+	script := fmt.Sprintf("/etc/init.d/net.br%v", vmId)
+	_, err := os.Lstat(script)
+	haveScript := err == nil
+
+	// deactivate the bridge
+	if haveScript && linkExists(bridgeName(vmId)) {
+		out, err := exec.Command(script, "stop").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("stopping bridge: %v %s", err, out)
+		}
+	}
+
+	// Bring down the vlan
+	if linkExists(vlanName(vmId)) {
+		out, err := exec.Command("ip", "link", "del", vlanName(vmId)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("removing vlan: %v %s", err, out)
+		}
+	}
+
+	// Remove autostart of bridge
+	if haveScript {
+		out, err := exec.Command("rc-update", "del", fmt.Sprintf("net.br%v", vmId)).CombinedOutput()
+		if err != nil {
+			// It may never have been added, which is fine, it's gone either way
+			fmt.Fprintf(os.Stderr, "error removing net.br%v from default runlevel: %v %s\n", vmId, err, out)
+		}
+	}
+
+	// Remove the bridge symlink, after which it's no longer part of the committed set
+	err = os.Remove(script)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing bridge symlink: %v", err)
+	}
+
+	// And finally out of the config, so the next reboot doesn't bring it back
+	return regenerateNetConfig()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Once torcontrol has set up a new VM's hidden service, tor takes anything from a second to a few minutes to write its
+// hostname. torcontrol publishes the VM's ID on onionready as soon as the hostname exists, and we ask for it then. We
+// also poll with a backoff, in case we missed the message or torcontrol restarted part way through.
+
+// How long creating a VM waits for its hostname before giving up, set with -onion-deadline
+var onionDeadline = 10 * time.Minute
+
+// The first poll comes this soon, and the gap doubles up to onionPollMax
+const onionPollMin = 2 * time.Second
+const onionPollMax = 30 * time.Second
+
+// VMs being created that are waiting for a hostname, woken by onionready
+var onionWaiters = struct {
+	mux     sync.Mutex
+	waiters map[int]chan struct{}
+}{waiters: make(map[int]chan struct{})}
+
+// Handle a message on onionready, the data is the VM's ID
+func onionReady(data []byte) {
+	vmId, err := strconv.Atoi(string(data))
+	if err != nil {
+		return
+	}
+
+	onionWaiters.mux.Lock()
+	defer onionWaiters.mux.Unlock()
+
+	ch, exists := onionWaiters.waiters[vmId]
+	if !exists {
+		return
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for torcontrol to have a hostname for the VM, for up to onionDeadline
+// notReady is passed on to torcontrolRequest
+func waitForOnion(vmId int, notReady func()) (string, error) {
+	ready := make(chan struct{}, 1)
+	onionWaiters.mux.Lock()
+	onionWaiters.waiters[vmId] = ready
+	onionWaiters.mux.Unlock()
+	defer func() {
+		onionWaiters.mux.Lock()
+		delete(onionWaiters.waiters, vmId)
+		onionWaiters.mux.Unlock()
+	}()
+
+	deadline := time.Now().Add(onionDeadline)
+	delay := onionPollMin
+	for {
+		status, err := torcontrolRequest(fmt.Sprintf("https://10.0.0.5/view/%v", vmId), notReady)
+		if err != nil {
+			return "", err
+		}
+		switch status {
+		case "invalid":
+			return "", errors.New("torcontrol says the VM is invalid")
+		case "unknown":
+			// Not written yet
+		default:
+			return status, nil
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return "", fmt.Errorf("no hostname after %v", onionDeadline)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		select {
+		case <-ready:
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > onionPollMax {
+			delay = onionPollMax
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// The resources a VM gets, picked by name when it's created
+type Plan struct {
+	Name string
+	// In MiB
+	Memory int
+	VCPUs  int
+	// In GiB, this is what the guest sees so it can't be smaller than the base image
+	DiskSize int
+	// How many ports the owner may open, enforced by the frontend
+	PortLimit int
+	// How many disk snapshots the owner may keep
+	SnapshotLimit int
+	// Whether the frontend offers it, plans that aren't sellable can still be created by hand
+	Sellable bool
+}
+
+// Where the plans are defined
+const plansFile = "assets/plans.json"
+
+// The plan a VM gets if the request doesn't name one, this matches what every VM got before plans existed
+const defaultPlan = "small"
+
+// Every plan, in the order they're listed in the file
+var plans []Plan
+
+var validPlanName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+func loadPlans() error {
+	buf, err := ioutil.ReadFile(plansFile)
+	if err != nil {
+		return err
+	}
+
+	var loaded []Plan
+	err = json.Unmarshal(buf, &loaded)
+	if err != nil {
+		return err
+	}
+
+	// Catch mistakes now rather than when someone tries to create a VM
+	seen := make(map[string]bool)
+	for _, p := range loaded {
+		if !validPlanName.MatchString(p.Name) {
+			return fmt.Errorf("invalid plan name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("plan %v is defined twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Memory < 128 || p.VCPUs < 1 || p.DiskSize < 1 || p.PortLimit < 0 || p.SnapshotLimit < 0 {
+			return fmt.Errorf("plan %v needs at least 128 MiB of memory, a vCPU, a GiB of disk and limits that aren't negative", p.Name)
+		}
+	}
+	if !seen[defaultPlan] {
+		return errors.New("the default plan " + defaultPlan + " is not defined")
+	}
+
+	plans = loaded
+	return nil
+}
+
+func findPlan(name string) (Plan, bool) {
+	for _, p := range plans {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// List every plan, for the frontend to pick what it can sell
+func plansHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+	b, err := json.Marshal(plans)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error json encoding our plans: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
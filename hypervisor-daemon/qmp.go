@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A client for the QEMU Machine Protocol, see qemu's docs/interop/qmp-spec.txt
+// Every guest is started with a QMP socket in its directory, and we open a short lived connection per command
+
+type QMP struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// A reply from qemu, which is either a return value, an error or an event we didn't ask for
+type qmpReply struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+func qmpSocket(vmId int) string {
+	return vmDir(vmId) + "/qmp.sock"
+}
+
+// Connect to a guest's QMP socket and get it ready to take commands
+func dialQMP(vmId int) (*QMP, error) {
+	conn, err := net.DialTimeout("unix", qmpSocket(vmId), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	q := &QMP{conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}
+
+	// qemu greets us with its version, then waits for capabilities negotiation
+	var greeting struct {
+		QMP json.RawMessage `json:"QMP"`
+	}
+	err = q.dec.Decode(&greeting)
+	if err != nil || greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("no QMP greeting from vm%v: %v", vmId, err)
+	}
+
+	_, err = q.execute("qmp_capabilities", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *QMP) Close() error {
+	return q.conn.Close()
+}
+
+// Run a command and return whatever it returned, skipping any events in the meantime
+func (q *QMP) execute(command string, arguments interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+	err := q.enc.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var reply qmpReply
+		err = q.dec.Decode(&reply)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Event != "" {
+			continue
+		}
+		if reply.Error != nil {
+			return nil, fmt.Errorf("%v: %v", reply.Error.Class, reply.Error.Desc)
+		}
+		return reply.Return, nil
+	}
+}
+
+// Run a single command against a guest
+func qmpCommand(vmId int, command string, arguments interface{}) (json.RawMessage, error) {
+	q, err := dialQMP(vmId)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	return q.execute(command, arguments)
+}
+
+// The run state of a guest as qemu sees it, e.g. running, paused, shutdown, guest-panicked
+func queryStatus(vmId int) (string, error) {
+	ret, err := qmpCommand(vmId, "query-status", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(ret, &status)
+	if err != nil {
+		return "", err
+	}
+	if status.Status == "" {
+		return "", errors.New("no status from query-status")
+	}
+
+	return status.Status, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// VMList is written through to the store, see store.go
+// That way a restart doesn't lose which VMs exist, what state they were left in, or their URLs
+
+// Write a VM's record
+func saveVM(vm VMInformation) error {
+	return saveVMs([]VMInformation{vm})
+}
+
+// Write several VMs' records at once
+func saveVMs(vms []VMInformation) error {
+	if len(vms) == 0 {
+		return nil
+	}
+
+	records := make([]VMInformation, 0, len(vms))
+	for _, vm := range vms {
+		// Health is only ever what the prober has seen since we started
+		vm.Health = ""
+		records = append(records, vm)
+	}
+	return store.SaveVMs(records)
+}
+
+// Fill the list from the registry when we start, then bring it in line with what's actually running
+func (v *VMList) reconcile() error {
+	records, err := store.LoadVMs()
+	if err != nil {
+		return err
+	}
+
+	// Whatever should be running, whether or not it was when we went down
+	var restore []int
+
+	v.mux.Lock()
+	for id, vm := range records {
+		if vm.Autostart && vm.ShouldRun {
+			restore = append(restore, id)
+		}
+		// Nothing is carrying on with a creation or deletion we were part way through when we stopped, so
+		// whatever it left behind needs looking at
+		if vm.Status == "creating" || vm.Status == "deleting" {
+			fmt.Fprintf(os.Stderr, "vm%v was %v when we stopped, marking it broken\n", id, vm.Status)
+			vm.Status = "broken"
+			err = saveVM(vm)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", id, err)
+			}
+		}
+		v.Vms[id] = vm
+	}
+	v.mux.Unlock()
+
+	fmt.Println(fmt.Sprintf("[%v] Loaded %v VMs from the registry", time.Now(), len(records)))
+
+	// sync takes it from here, VMs with no process become stopped and unknown guests are recorded
+	err = v.sync()
+	if err != nil {
+		return err
+	}
+
+	// Only the ones that didn't survive, if only we restarted they're all still running
+	var stopped []int
+	v.mux.Lock()
+	for _, id := range restore {
+		if v.Vms[id].Status == "stopped" {
+			stopped = append(stopped, id)
+		}
+	}
+	v.mux.Unlock()
+	go v.restoreGuests(stopped)
+
+	return nil
+}
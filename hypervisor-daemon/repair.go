@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A broken VM is usually only missing one or two things, e.g. its bridge after a bad reboot, or its hidden service
+// after the pi lost it. POST /vm/N/repair looks at what actually exists and only does the steps of creating it that
+// are missing, so the owner keeps their disk whenever it's still there.
+
+func repairHandler(w http.ResponseWriter, r *http.Request, vmId int, v *VMList) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Only broken VMs, anything else is either fine or has something else working on it
+	v.mux.Lock()
+	broken := v.Vms[vmId].Status == "broken"
+	v.mux.Unlock()
+	if !broken {
+		http.Error(w, "not-broken", http.StatusConflict)
+		return
+	}
+
+	// A create or delete that broke it may still be cleaning up
+	job := newJobIfIdle("repair", vmId, createSteps...)
+	if job == nil {
+		http.Error(w, "busy", http.StatusConflict)
+		return
+	}
+
+	// It's being created again as far as everything else is concerned, and ends up complete or broken the same way
+	v.mux.Lock()
+	vminfo := v.Vms[vmId]
+	if vminfo.Status != "broken" {
+		v.mux.Unlock()
+		job.finish(errors.New("no longer broken"))
+		http.Error(w, "not-broken", http.StatusConflict)
+		return
+	}
+	vminfo.Status = "creating"
+	v.Vms[vmId] = vminfo
+	v.mux.Unlock()
+	err := saveVM(vminfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving vm%v to the registry: %v\n", vmId, err)
+	}
+
+	go repairVM(vmId, vminfo, v, job)
+	w.Header().Set("X-Job-Id", job.Id)
+	fmt.Fprintf(w, "repairing")
+}
+
+// Redo whichever steps of createVM a VM is missing, leaving it broken again if any of them fail
+// Unlike createVM nothing is rolled back, whatever we did manage to fix is still fixed next time
+func repairVM(vmId int, vminfo VMInformation, v *VMList, job *trackedJob) {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error repairing vm%v: %v\n", vmId, err)
+			v.updateVM(vmId, "broken", vminfo.URL)
+		}
+		job.finish(err)
+	}()
+
+	fmt.Println(fmt.Sprintf("[%v] Repairing vm%v", time.Now(), vmId))
+	resources, err := backend.Resources(vmId)
+	if err != nil {
+		return
+	}
+	state, inspectErr := backend.Inspect(vmId)
+	running := inspectErr == nil && state.Running
+
+	// A new disk needs the plan and image it was created with
+	job.step("disk")
+	recreated := false
+	if !resources.Disk {
+		plan, ok := findPlan(vminfo.Plan)
+		if !ok {
+			err = fmt.Errorf("recreating disk: unknown plan %q", vminfo.Plan)
+			return
+		}
+		img, ok := findImage(vminfo.Image)
+		if !ok {
+			err = fmt.Errorf("recreating disk: unknown image %q", vminfo.Image)
+			return
+		}
+		fmt.Println(fmt.Sprintf("[%v] vm%v has no disk, creating a new one from %v", time.Now(), vmId, img.Id))
+
+		// Whatever is left of the old one has to go first
+		if running {
+			err = backend.Stop(vmId)
+			if err != nil {
+				return
+			}
+			running = false
+		}
+		err = backend.RemoveDisk(vmId)
+		if err != nil {
+			return
+		}
+		err = backend.ProvisionDisk(vmId, plan, img)
+		if err != nil {
+			return
+		}
+		recreated = true
+	}
+
+	// Half a network is no use, so take down whatever there is and set it up again
+	job.step("vlan")
+	if !resources.Network.complete() {
+		fmt.Println(fmt.Sprintf("[%v] vm%v's network is incomplete (%+v), setting it up again", time.Now(), vmId, resources.Network))
+		if running {
+			err = backend.Stop(vmId)
+			if err != nil {
+				return
+			}
+			running = false
+		}
+		err = backend.DetachNetwork(vmId)
+		if err != nil {
+			return
+		}
+		err = backend.AttachNetwork(vmId)
+		if err != nil {
+			return
+		}
+	}
+
+	// Start it the way it last ran, unless it's a new disk or it never ran, in which case the way createVM would
+	job.step("qemu")
+	if !running {
+		if !recreated {
+			err = backend.Restore(vmId)
+		}
+		if recreated || err == errNoArgs {
+			plan, ok := findPlan(vminfo.Plan)
+			if !ok {
+				err = fmt.Errorf("starting qemu: unknown plan %q", vminfo.Plan)
+				return
+			}
+			img, ok := findImage(vminfo.Image)
+			if !ok {
+				err = fmt.Errorf("starting qemu: unknown image %q", vminfo.Image)
+				return
+			}
+			err = backend.Start(vmId, plan, img)
+		}
+		if err != nil {
+			return
+		}
+	}
+	v.setShouldRun(vmId, true)
+
+	// If the pi still has a hostname for it, the hidden service is fine
+	job.step("tor")
+	status, err := torcontrolRequest(fmt.Sprintf("https://10.0.0.5/view/%v", vmId), nil)
+	if err != nil {
+		err = fmt.Errorf("talking to torcontrol: %v", err)
+		return
+	}
+	if status == "unknown" {
+		// Clear out anything half made on the pi first, it won't create over it
+		torcontrolRequest(fmt.Sprintf("https://10.0.0.5/delete/%v", vmId), nil)
+		status, err = torcontrolRequest(fmt.Sprintf("https://10.0.0.5/create/%v", vmId), nil)
+		if err != nil {
+			err = fmt.Errorf("talking to torcontrol: %v", err)
+			return
+		}
+		if status != "creating" {
+			err = fmt.Errorf("unexpected response from torcontrol: %v", status)
+			return
+		}
+
+		job.step("hostname")
+		status, err = waitForOnion(vmId, nil)
+		if err != nil {
+			err = fmt.Errorf("fetching hostname: %v", err)
+			return
+		}
+	} else if status == "invalid" {
+		err = fmt.Errorf("unexpected response from torcontrol: %v", status)
+		return
+	}
+
+	fmt.Println(fmt.Sprintf("[%v] Repaired vm%v", time.Now(), vmId))
+	v.updateVM(vmId, "complete", status)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Internal qcow2 snapshots of a VM's disk, so owners have something to go back to after a bad upgrade
+// They live inside the VM's own overlay, so they go away with it and never touch the base image
+
+// A snapshot of a VM's disk
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+var validSnapshotName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// The qemu device name of a VM's disk, which is what a lone if=virtio drive gets
+const diskDevice = "virtio0"
+
+// A VM's disk, whichever image it was created from
+func diskFile(vmId int) (string, error) {
+	disks, err := filepath.Glob(fmt.Sprintf("%v/vm%v-*.img", vmDir(vmId), vmId))
+	if err != nil {
+		return "", err
+	}
+	if len(disks) != 1 {
+		return "", fmt.Errorf("expected one disk for vm%v, found %v", vmId, len(disks))
+	}
+	return disks[0], nil
+}
+
+// The snapshots as qemu-img info and query-block describe them
+type qemuSnapshots struct {
+	Snapshots []struct {
+		Name    string `json:"name"`
+		DateSec int64  `json:"date-sec"`
+	} `json:"snapshots"`
+}
+
+func (q qemuSnapshots) list() []Snapshot {
+	snapshots := []Snapshot{}
+	for _, s := range q.Snapshots {
+		snapshots = append(snapshots, Snapshot{Name: s.Name, Created: time.Unix(s.DateSec, 0)})
+	}
+	return snapshots
+}
+
+// List a VM's snapshots, or create, revert to or delete one
+// GET /vm/N/snapshot lists them, POST /vm/N/snapshot?action=create&name=before-upgrade does the rest
+func snapshotHandler(w http.ResponseWriter, r *http.Request, vmId int, v *VMList) {
+	if r.Method == "GET" {
+		snapshots, err := backend.ListSnapshots(vmId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error listing snapshots of vm%v: %v\n", vmId, err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(snapshots)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error json encoding snapshots: %v\n", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Everything comes in the query string, so it is covered by the request signature
+	action := r.URL.Query().Get("action")
+	name := r.URL.Query().Get("name")
+	if !validSnapshotName.MatchString(name) {
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+	if action != "create" && action != "revert" && action != "delete" {
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+
+	// Reverting restarts qemu, so leave alone anything being created, deleted, repaired or suspended
+	v.mux.Lock()
+	vminfo := v.Vms[vmId]
+	v.mux.Unlock()
+	if vminfo.Status != "complete" && vminfo.Status != "running" && vminfo.Status != "stopped" {
+		http.Error(w, "not-ready", http.StatusConflict)
+		return
+	}
+
+	// Only one thing at a time on a guest, which also keeps two creates from both fitting under the limit
+	job := newJobIfIdle("snapshot", vmId, action)
+	if job == nil {
+		http.Error(w, "busy", http.StatusConflict)
+		return
+	}
+	w.Header().Set("X-Job-Id", job.Id)
+	job.step(action)
+
+	snapshots, err := backend.ListSnapshots(vmId)
+	if err != nil {
+		job.finish(err)
+		fmt.Fprintf(os.Stderr, "error listing snapshots of vm%v: %v\n", vmId, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	exists := false
+	for _, s := range snapshots {
+		if s.Name == name {
+			exists = true
+		}
+	}
+
+	// Checked before touching the disk, the job records why we didn't
+	switch action {
+	case "create":
+		if exists {
+			job.finish(fmt.Errorf("snapshot %v already exists", name))
+			http.Error(w, "exists", http.StatusConflict)
+			return
+		}
+		// VMs we've lost the plan of get the default's limit
+		plan, ok := findPlan(vminfo.Plan)
+		if !ok {
+			plan, _ = findPlan(defaultPlan)
+		}
+		if len(snapshots) >= plan.SnapshotLimit {
+			job.finish(fmt.Errorf("plan %v allows %v snapshot(s)", plan.Name, plan.SnapshotLimit))
+			http.Error(w, "limit", http.StatusForbidden)
+			return
+		}
+	case "revert", "delete":
+		if !exists {
+			job.finish(fmt.Errorf("no snapshot %v", name))
+			http.Error(w, "unknown", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Snapshots are quick enough to do while the frontend waits, but they still get a job so there's a record
+	switch action {
+	case "create":
+		err = backend.CreateSnapshot(vmId, name)
+	case "revert":
+		err = backend.RevertSnapshot(vmId, name)
+	case "delete":
+		err = backend.DeleteSnapshot(vmId, name)
+	}
+	job.finish(err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error with %v of snapshot %v of vm%v: %v\n", action, name, vmId, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Println(fmt.Sprintf("[%v] %v of snapshot %v of vm%v done", time.Now(), action, name, vmId))
+	fmt.Fprintf(w, "ok")
+}
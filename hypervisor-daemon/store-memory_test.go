@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+)
+
+// A Store that only keeps things in memory, so the handlers can be run without redis
+// Jobs never expire, nothing in a test runs for jobRetention
+
+type memoryStore struct {
+	mux        sync.Mutex
+	vms        map[int]VMInformation
+	jobs       map[string]Job
+	latestJobs map[int]string
+	// Every message published, by channel, oldest first
+	published map[string][][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		vms:        make(map[int]VMInformation),
+		jobs:       make(map[string]Job),
+		latestJobs: make(map[int]string),
+		published:  make(map[string][][]byte),
+	}
+}
+
+func (m *memoryStore) SaveVMs(vms []VMInformation) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, vm := range vms {
+		m.vms[vm.Id] = vm
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteVM(vmId int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.vms, vmId)
+	return nil
+}
+
+func (m *memoryStore) LoadVMs() (map[int]VMInformation, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	vms := make(map[int]VMInformation)
+	for id, vm := range m.vms {
+		vms[id] = vm
+	}
+	return vms, nil
+}
+
+func (m *memoryStore) SaveJob(job Job) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.jobs[job.Id] = job
+	return nil
+}
+
+func (m *memoryStore) SaveLatestJob(vmId int, id string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.latestJobs[vmId] = id
+	return nil
+}
+
+func (m *memoryStore) FindJob(id string) (Job, bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	job, exists := m.jobs[id]
+	return job, exists, nil
+}
+
+func (m *memoryStore) Publish(channel string, message []byte) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.published[channel] = append(m.published[channel], message)
+	return nil
+}
+
+// The record of a VM, false if there isn't one
+func (m *memoryStore) vm(vmId int) (VMInformation, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	vm, exists := m.vms[vmId]
+	return vm, exists
+}
+
+// The messages published on a channel so far
+func (m *memoryStore) messages(channel string) [][]byte {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return append([][]byte{}, m.published[channel]...)
+}
+
+// The ID of the latest job on a VM, empty if it's never had one
+func (m *memoryStore) latestJob(vmId int) string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.latestJobs[vmId]
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"strconv"
+)
+
+// The real Store, everything in redis on the hypervisor
+// VMs are kept in a hash, one field per VM holding its VMInformation as JSON, and jobs each under their own key,
+// which redis expires after jobRetention
+
+type redisStore struct{}
+
+// The hash we keep VMs in, set with -registry so a fake backend doesn't trample the real one's records
+var registryKey = "hypervisor:vms"
+
+func jobKey(id string) string {
+	return fmt.Sprintf("job:%v", id)
+}
+
+func latestJobKey(vmId int) string {
+	return fmt.Sprintf("vm:%v:job", vmId)
+}
+
+func storeConn() (redis.Conn, error) {
+	return redis.Dial("tcp", "10.0.5.20:6379")
+}
+
+// All on a single connection
+func (redisStore) SaveVMs(vms []VMInformation) error {
+	if len(vms) == 0 {
+		return nil
+	}
+
+	redisCon, err := storeConn()
+	if err != nil {
+		return err
+	}
+	defer redisCon.Close()
+
+	for _, vm := range vms {
+		b, err := json.Marshal(vm)
+		if err != nil {
+			return err
+		}
+		redisCon.Send("HSET", registryKey, vm.Id, b)
+	}
+	err = redisCon.Flush()
+	if err != nil {
+		return err
+	}
+	for range vms {
+		_, err = redisCon.Receive()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (redisStore) DeleteVM(vmId int) error {
+	redisCon, err := storeConn()
+	if err != nil {
+		return err
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("HDEL", registryKey, vmId)
+	return err
+}
+
+func (redisStore) LoadVMs() (map[int]VMInformation, error) {
+	redisCon, err := storeConn()
+	if err != nil {
+		return nil, err
+	}
+	defer redisCon.Close()
+
+	fields, err := redis.StringMap(redisCon.Do("HGETALL", registryKey))
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make(map[int]VMInformation)
+	for field, value := range fields {
+		vmId, err := strconv.Atoi(field)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ignoring registry entry %q: %v\n", field, err)
+			continue
+		}
+		var vm VMInformation
+		err = json.Unmarshal([]byte(value), &vm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ignoring registry entry for vm%v: %v\n", vmId, err)
+			continue
+		}
+		// Records from before ShouldRun only have the status to go on
+		var flags struct {
+			ShouldRun *bool
+		}
+		json.Unmarshal([]byte(value), &flags)
+		if flags.ShouldRun == nil {
+			vm.ShouldRun = wasUp(vm.Status)
+		}
+		vm.Id = vmId
+		vms[vmId] = vm
+	}
+
+	return vms, nil
+}
+
+func (redisStore) SaveJob(job Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	redisCon, err := storeConn()
+	if err != nil {
+		return err
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("SET", jobKey(job.Id), b, "EX", int(jobRetention.Seconds()))
+	return err
+}
+
+func (redisStore) SaveLatestJob(vmId int, id string) error {
+	redisCon, err := storeConn()
+	if err != nil {
+		return err
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("SET", latestJobKey(vmId), id, "EX", int(jobRetention.Seconds()))
+	return err
+}
+
+func (redisStore) FindJob(id string) (Job, bool, error) {
+	redisCon, err := storeConn()
+	if err != nil {
+		return Job{}, false, err
+	}
+	defer redisCon.Close()
+
+	b, err := redis.Bytes(redisCon.Do("GET", jobKey(id)))
+	if err == redis.ErrNil {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	var job Job
+	err = json.Unmarshal(b, &job)
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func (redisStore) Publish(channel string, message []byte) error {
+	redisCon, err := storeConn()
+	if err != nil {
+		return err
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("PUBLISH", channel, message)
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+// Everything we keep in redis goes through a Store: the registry of VMs (see registry.go), the jobs, and the
+// acknowledgements we publish for the other daemons. redisStore is the real one, the tests use one that keeps
+// everything in memory so they can run without redis.
+
+type Store interface {
+	// Write VMs' records, replacing whatever was there
+	SaveVMs(vms []VMInformation) error
+	// Remove a VM's record, once it's gone for good
+	DeleteVM(vmId int) error
+	// Every VM we have a record of
+	LoadVMs() (map[int]VMInformation, error)
+
+	// Write a job, it only has to be kept for jobRetention
+	SaveJob(job Job) error
+	// Record a job as the latest one on its VM, which is how the frontend finds it
+	SaveLatestJob(vmId int, id string) error
+	// A job we saved, false if there's no such job or it's expired
+	FindJob(id string) (Job, bool, error)
+
+	// Tell the other daemons about something, e.g. on vmdeleted
+	Publish(channel string, message []byte) error
+}
+
+// Where we keep everything
+var store Store = redisStore{}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// We run qemu ourselves rather than inside screen, so we know the PID of every guest, how it exited, and can restart
+// it if it crashes. Each VM's directory holds a pidfile and the arguments it was started with, so after we restart we
+// can pick up guests that are still running and relaunch them identically.
+
+// A guest that crashes more than this many times in the window is left down
+const maxRestarts = 3
+const restartWindow = 10 * time.Minute
+
+// Don't restart a crashed guest straight away, in case whatever killed it is still going on
+const restartDelay = 5 * time.Second
+
+// How long a guest gets to exit after SIGTERM before we SIGKILL it
+const stopTimeout = 30 * time.Second
+
+// How often we check on guests we adopted from a pidfile, since we can't wait() on them
+const adoptedPollInterval = 5 * time.Second
+
+// A qemu process we're looking after
+type guestProcess struct {
+	VmId    int
+	Args    []string
+	Pid     int
+	Running bool
+	Started time.Time
+	// How the last run ended, -1 if it was killed by a signal or we never saw it exit
+	ExitCode int
+	Exited   time.Time
+	// When we automatically restarted it recently
+	Restarts []time.Time
+	// Set when we asked it to stop, so we don't restart it
+	stopping bool
+	// Where the next launch loads the guest's memory from, only that launch, so if it crashes later it boots afresh
+	incoming string
+	// Closed when the current process exits
+	done chan struct{}
+}
+
+type Supervisor struct {
+	mux    sync.Mutex
+	guests map[int]*guestProcess
+}
+
+var supervisor = &Supervisor{guests: make(map[int]*guestProcess)}
+
+func vmDir(vmId int) string {
+	return fmt.Sprintf("/root/vm-images/vm%v", vmId)
+}
+
+// Start qemu for a VM with the given arguments, and keep it running
+func (s *Supervisor) start(vmId int, args []string) error {
+	return s.startIncoming(vmId, args, "")
+}
+
+// Start qemu the same way, but with the guest's memory loaded from a migration, e.g. exec:cat memory.state
+// Only args are kept for restarting it, the migration is a one off
+func (s *Supervisor) startIncoming(vmId int, args []string, incoming string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if g, exists := s.guests[vmId]; exists && g.Running {
+		return errors.New("already running")
+	}
+
+	// Keep the arguments so we can start it the same way after we restart
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(vmDir(vmId)+"/qemu.args", b, 0644)
+	if err != nil {
+		return err
+	}
+
+	g := &guestProcess{VmId: vmId, Args: args, incoming: incoming}
+	if old, exists := s.guests[vmId]; exists {
+		g.Restarts = old.Restarts
+	}
+	s.guests[vmId] = g
+
+	return s.launch(g)
+}
+
+// Actually start the process, the caller must hold the lock
+func (s *Supervisor) launch(g *guestProcess) error {
+	// Anything qemu itself complains about goes to qemu.log
+	stderr, err := os.OpenFile(vmDir(g.VmId)+"/qemu.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	// The guest's serial console is on a socket we read into console.log, see console.go
+	// Guests created before that still have it on stdout, so that goes straight to console.log for them
+	stdout := stderr
+	socketConsole := hasConsoleSocket(g.Args)
+	if !socketConsole {
+		console, err := os.OpenFile(consoleLogFile(g.VmId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer console.Close()
+		stdout = console
+	}
+
+	args := g.Args
+	if g.incoming != "" {
+		args = append(append([]string{}, g.Args...), "-incoming", g.incoming)
+		g.incoming = ""
+	}
+
+	fmt.Fprintf(stderr, "[%v] Starting qemu-system-x86_64 %v\n", time.Now(), strings.Join(args, " "))
+
+	cmd := exec.Command("qemu-system-x86_64", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Our own process group, so a signal to the daemon doesn't take every guest with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	g.Pid = cmd.Process.Pid
+	g.Running = true
+	g.Started = time.Now()
+	g.stopping = false
+	g.done = make(chan struct{})
+
+	err = ioutil.WriteFile(vmDir(g.VmId)+"/qemu.pid", []byte(strconv.Itoa(g.Pid)), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing pidfile for vm%v: %v\n", g.VmId, err)
+	}
+
+	if socketConsole {
+		go watchConsole(g.VmId, g.done)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		exitCode := 0
+		if err != nil {
+			exitCode = -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+					exitCode = status.ExitStatus()
+				}
+			}
+		}
+		s.exited(g, exitCode)
+	}()
+
+	return nil
+}
+
+// Called once a guest's process has gone away, decides whether to bring it back
+func (s *Supervisor) exited(g *guestProcess, exitCode int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	g.Running = false
+	g.ExitCode = exitCode
+	g.Exited = time.Now()
+	close(g.done)
+	os.Remove(vmDir(g.VmId) + "/qemu.pid")
+
+	fmt.Println(fmt.Sprintf("[%v] qemu for vm%v (pid %v) exited with %v", time.Now(), g.VmId, g.Pid, exitCode))
+
+	// A clean exit means the guest powered itself off, which is the owner's business
+	if g.stopping {
+		return
+	}
+	if exitCode == 0 {
+		s.stopped(g.VmId)
+		return
+	}
+
+	// Only count restarts inside the window
+	var recent []time.Time
+	for _, t := range g.Restarts {
+		if time.Since(t) < restartWindow {
+			recent = append(recent, t)
+		}
+	}
+	g.Restarts = recent
+	if len(g.Restarts) >= maxRestarts {
+		fmt.Fprintf(os.Stderr, "vm%v crashed %v times in %v, not restarting it\n", g.VmId, len(g.Restarts), restartWindow)
+		s.stopped(g.VmId)
+		return
+	}
+	g.Restarts = append(g.Restarts, time.Now())
+
+	go func() {
+		time.Sleep(restartDelay)
+
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		// Someone may have stopped or replaced it while we slept
+		if s.guests[g.VmId] != g || g.Running || g.stopping {
+			return
+		}
+		fmt.Println(fmt.Sprintf("[%v] Restarting crashed vm%v", time.Now(), g.VmId))
+		err := s.launch(g)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error restarting vm%v: %v\n", g.VmId, err)
+		}
+	}()
+}
+
+// Let everyone know a guest is down for good, we hold the lock so this has to happen without it
+func (s *Supervisor) stopped(vmId int) {
+	if guestStopped != nil {
+		go guestStopped(vmId)
+	}
+}
+
+// Stop a guest, first asking nicely and then not
+func (s *Supervisor) stop(vmId int) error {
+	s.mux.Lock()
+	g, exists := s.guests[vmId]
+	if !exists || !g.Running {
+		s.mux.Unlock()
+		return errors.New("not running")
+	}
+	g.stopping = true
+	pid := g.Pid
+	done := g.done
+	s.mux.Unlock()
+
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(stopTimeout):
+	}
+
+	fmt.Fprintf(os.Stderr, "vm%v did not exit after SIGTERM, killing it\n", vmId)
+	err = syscall.Kill(pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+	<-done
+
+	return nil
+}
+
+// Forget about a guest entirely, once it's been deleted
+func (s *Supervisor) forget(vmId int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.guests, vmId)
+}
+
+// A copy of what we know about a guest
+func (s *Supervisor) status(vmId int) (guestProcess, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	g, exists := s.guests[vmId]
+	if !exists {
+		return guestProcess{}, false
+	}
+	return *g, true
+}
+
+// Every guest we know about, running or not
+func (s *Supervisor) list() map[int]guestProcess {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	guests := make(map[int]guestProcess)
+	for id, g := range s.guests {
+		guests[id] = *g
+	}
+	return guests
+}
+
+// Pick up guests that were started before we were, using the pidfiles they left behind
+func (s *Supervisor) adopt() error {
+	pidfiles, err := filepath.Glob("/root/vm-images/vm*/qemu.pid")
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, pidfile := range pidfiles {
+		vmId, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(pidfile)), "vm"))
+		if err != nil {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(pidfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %v: %v\n", pidfile, err)
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil || !isQemu(pid) {
+			// Stale, the guest went away while we weren't looking
+			fmt.Fprintf(os.Stderr, "removing stale pidfile %v\n", pidfile)
+			os.Remove(pidfile)
+			continue
+		}
+
+		var args []string
+		buf, err = ioutil.ReadFile(vmDir(vmId) + "/qemu.args")
+		if err == nil {
+			err = json.Unmarshal(buf, &args)
+		}
+		if err != nil {
+			// We can still watch it, we just won't be able to restart it
+			fmt.Fprintf(os.Stderr, "no usable arguments for vm%v, it won't be restarted if it crashes: %v\n", vmId, err)
+		}
+
+		g := &guestProcess{VmId: vmId, Args: args, Pid: pid, Running: true, Started: time.Now(), done: make(chan struct{})}
+		s.guests[vmId] = g
+		go s.watchAdopted(g)
+		if hasConsoleSocket(args) {
+			go watchConsole(vmId, g.done)
+		}
+
+		fmt.Println(fmt.Sprintf("[%v] Adopted running vm%v (pid %v)", time.Now(), vmId, pid))
+	}
+
+	return nil
+}
+
+// Poll a guest that isn't our child until it goes away
+func (s *Supervisor) watchAdopted(g *guestProcess) {
+	for isQemu(g.Pid) {
+		time.Sleep(adoptedPollInterval)
+	}
+
+	// We can't know the exit code of a process we didn't start, so treat it as a crash unless we stopped it
+	if g.Args == nil {
+		s.mux.Lock()
+		g.stopping = true
+		s.mux.Unlock()
+	}
+	s.exited(g, -1)
+}
+
+// Whether a guest's serial console is on a socket
+func hasConsoleSocket(args []string) bool {
+	for i, arg := range args {
+		if arg == "-serial" && i+1 < len(args) && strings.HasPrefix(args[i+1], "unix:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether pid is a live qemu process, rather than something that reused the PID
+func isQemu(pid int) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmdline), "qemu-system")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// An idle guest still holds on to all of its plan's memory, so owners can suspend it instead: its memory is saved next
+// to its disk, the same way qemu migrates a guest to another host, and qemu exits. Resuming starts qemu with the saved
+// memory as an incoming migration, and the guest carries on as if nothing happened. A suspended guest isn't restarted
+// after a reboot, it stays suspended until its owner resumes it.
+
+// How long saving or loading a guest's memory may take
+const suspendTimeout = 10 * time.Minute
+
+// How often we ask qemu how it's getting on
+const suspendPollInterval = time.Second
+
+// Where a suspended guest's memory is kept
+func stateFile(vmId int) string {
+	return vmDir(vmId) + "/memory.state"
+}
+
+// Throw away a guest's saved memory, once it's been resumed or is being booted afresh
+func discardState(vmId int) error {
+	err := os.Remove(stateFile(vmId))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing saved memory: %v", err)
+	}
+	return nil
+}
+
+// Migrate a guest's memory to uri, and wait for it to finish
+func migrate(vmId int, uri string) error {
+	_, err := qmpCommand(vmId, "migrate", map[string]string{"uri": uri})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(suspendTimeout)
+	for time.Now().Before(deadline) {
+		ret, err := qmpCommand(vmId, "query-migrate", nil)
+		if err != nil {
+			return err
+		}
+		var info struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		}
+		err = json.Unmarshal(ret, &info)
+		if err != nil {
+			return err
+		}
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %v: %v", info.Status, info.ErrorDesc)
+		}
+		time.Sleep(suspendPollInterval)
+	}
+
+	qmpCommand(vmId, "migrate_cancel", nil)
+	return fmt.Errorf("migration took longer than %v", suspendTimeout)
+}
+
+// Wait for a guest started with -incoming to load its memory, and make sure it's running afterwards
+func waitForIncoming(vmId int) error {
+	deadline := time.Now().Add(suspendTimeout)
+	for time.Now().Before(deadline) {
+		if g, exists := supervisor.status(vmId); !exists || !g.Running {
+			return errors.New("qemu exited")
+		}
+
+		// The socket may not be there yet, so failing to ask isn't fatal
+		status, err := queryStatus(vmId)
+		if err == nil && status != "inmigrate" {
+			// It comes back paused, as that's how it was when it was saved
+			if status == "paused" || status == "postmigrate" {
+				_, err = qmpCommand(vmId, "cont", nil)
+				return err
+			}
+			if status == "running" {
+				return nil
+			}
+			return fmt.Errorf("guest is %v", status)
+		}
+		time.Sleep(suspendPollInterval)
+	}
+	return fmt.Errorf("loading took longer than %v", suspendTimeout)
+}
+
+// Suspend or resume a guest, POST /vm/N/suspend or /vm/N/resume
+// They can take a while, so they run as a job and the status changes to suspended or running once done
+func suspendHandler(w http.ResponseWriter, r *http.Request, vmId int, v *VMList, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Anything being created, deleted or repaired is left alone, as is anything broken
+	v.mux.Lock()
+	vminfo := v.Vms[vmId]
+	v.mux.Unlock()
+	if action == "suspend" {
+		if vminfo.Status != "complete" && vminfo.Status != "running" {
+			http.Error(w, "not-running", http.StatusConflict)
+			return
+		}
+		state, err := backend.Inspect(vmId)
+		if err != nil || !state.Running {
+			http.Error(w, "not-running", http.StatusConflict)
+			return
+		}
+	} else if vminfo.Status != "suspended" {
+		http.Error(w, "not-suspended", http.StatusConflict)
+		return
+	}
+
+	// Only one thing at a time on a guest
+	job := newJobIfIdle(action, vmId, action)
+	if job == nil {
+		http.Error(w, "busy", http.StatusConflict)
+		return
+	}
+	go func() {
+		job.step(action)
+		var err error
+		status := "suspended"
+		if action == "suspend" {
+			err = backend.Suspend(vmId)
+		} else {
+			err = backend.Resume(vmId)
+			status = "running"
+		}
+		if err != nil {
+			// Whatever it's doing now, sync will find out
+			fmt.Fprintf(os.Stderr, "error with %v of vm%v: %v\n", action, vmId, err)
+			job.finish(err)
+			return
+		}
+
+		// Before the job finishes, so anyone waiting on it sees the new status
+		fmt.Println(fmt.Sprintf("[%v] %v of vm%v done", time.Now(), action, vmId))
+		v.setShouldRun(vmId, action == "resume")
+		v.updateVM(vmId, status, vminfo.URL)
+		job.finish(nil)
+	}()
+
+	w.Header().Set("X-Job-Id", job.Id)
+	if action == "suspend" {
+		fmt.Fprintf(w, "suspending")
+	} else {
+		fmt.Fprintf(w, "resuming")
+	}
+}
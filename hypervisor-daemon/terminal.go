@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interactive sessions on a guest's serial console, for when its owner can't get in over SSH
+// The frontend opens a websocket to /vm/N/console/attach and relays it to the owner's browser. Sessions end after a
+// while without any typing, or after a fixed time whatever happens, and every one is recorded in redis.
+
+// A session with nothing typed for this long is closed
+const terminalIdleTimeout = 10 * time.Minute
+
+// And no session lasts longer than this
+const terminalMaxSession = time.Hour
+
+// How many past sessions we keep a record of per VM
+const terminalAuditLength = 100
+
+// The frontend is the only client, and it has already checked the owner's session
+var terminalUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// What we remember about a terminal session
+type terminalRecord struct {
+	Start time.Time
+	End   time.Time
+	// Who the frontend says it was for, e.g. owner
+	Who string
+	// Why it ended: closed, idle, limit or console (the guest went away)
+	Ended string
+}
+
+func terminalAuditKey(vmId int) string {
+	return fmt.Sprintf("vm:%v:consoleaudit", vmId)
+}
+
+// Add a session to the VM's audit list, newest first
+func auditTerminal(vmId int, record terminalRecord) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error json encoding terminal record: %v\n", err)
+		return
+	}
+
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to redis: %v\n", err)
+		return
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("LPUSH", terminalAuditKey(vmId), b)
+	if err == nil {
+		_, err = redisCon.Do("LTRIM", terminalAuditKey(vmId), 0, terminalAuditLength-1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error recording terminal session for vm%v: %v\n", vmId, err)
+	}
+}
+
+// Relay a websocket to a guest's serial console, e.g. /vm/100/console/attach?who=owner
+func terminalHandler(w http.ResponseWriter, r *http.Request, vmId int) {
+	who := r.URL.Query().Get("who")
+	if who == "" {
+		who = "unknown"
+	}
+
+	console, err := backend.AttachConsole(vmId)
+	if err == errConsoleBusy {
+		http.Error(w, "busy", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error attaching to console of vm%v: %v\n", vmId, err)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer console.Close()
+
+	ws, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already told the client
+		return
+	}
+	defer ws.Close()
+
+	record := terminalRecord{Start: time.Now(), Who: who}
+	fmt.Println(fmt.Sprintf("[%v] Terminal session on vm%v for %v started", time.Now(), vmId, who))
+
+	// Whichever way the session ends, the first reason wins
+	var endOnce sync.Once
+	ended := make(chan string, 1)
+	end := func(reason string) {
+		endOnce.Do(func() {
+			ended <- reason
+		})
+	}
+
+	// Guest output to the websocket
+	var writeMux sync.Mutex
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := console.Read(buf)
+			if n > 0 {
+				writeMux.Lock()
+				ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
+				werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n])
+				writeMux.Unlock()
+				if werr != nil {
+					end("closed")
+					return
+				}
+			}
+			if err != nil {
+				end("console")
+				return
+			}
+		}
+	}()
+
+	// Typing from the websocket to the guest, anything counts as activity
+	activity := make(chan struct{}, 1)
+	go func() {
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				end("closed")
+				return
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+			_, err = console.Write(msg)
+			if err != nil {
+				end("console")
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTimer(terminalIdleTimeout)
+	defer idle.Stop()
+	limit := time.NewTimer(terminalMaxSession)
+	defer limit.Stop()
+
+	for record.Ended == "" {
+		select {
+		case <-activity:
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(terminalIdleTimeout)
+		case <-idle.C:
+			record.Ended = "idle"
+		case <-limit.C:
+			record.Ended = "limit"
+		case reason := <-ended:
+			record.Ended = reason
+		}
+	}
+
+	// Say why before hanging up, if they're still there to hear it
+	writeMux.Lock()
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, record.Ended), time.Now().Add(5*time.Second))
+	writeMux.Unlock()
+
+	record.End = time.Now()
+	fmt.Println(fmt.Sprintf("[%v] Terminal session on vm%v for %v ended (%v)", time.Now(), vmId, who, record.Ended))
+	auditTerminal(vmId, record)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Anything on the management VLANs can reach us, so we only act on requests signed by the hypervisor
+// docs/request-signing.md is the canonical format, hypervisor-daemon/auth.go signs and the two need to agree
+
+// Where the shared key lives, relative to where the daemon runs
+const controlKeyFile = "config/control.key"
+
+// How far a request's timestamp may be from our clock
+const signatureWindow = 60 * time.Second
+
+var controlKey []byte
+
+// Nonces we've accepted, and when we can forget them
+var seenNonces = struct {
+	mux    sync.Mutex
+	nonces map[string]time.Time
+}{nonces: make(map[string]time.Time)}
+
+func loadControlKey() error {
+	key, err := ioutil.ReadFile(controlKeyFile)
+	if err != nil {
+		return err
+	}
+	if len(key) < 32 {
+		return errors.New("control key is too short, it needs at least 32 bytes")
+	}
+
+	controlKey = key
+	return nil
+}
+
+func requestSignature(method string, path string, timestamp string, nonce string) string {
+	mac := hmac.New(sha256.New, controlKey)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v", method, path, timestamp, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature on a request from another daemon
+func verifyRequest(r *http.Request) error {
+	timestamp := r.Header.Get("X-Torhost-Timestamp")
+	nonce := r.Header.Get("X-Torhost-Nonce")
+	signature := r.Header.Get("X-Torhost-Signature")
+	if timestamp == "" || nonce == "" || signature == "" {
+		return errors.New("request is not signed")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > signatureWindow || age < -signatureWindow {
+		return fmt.Errorf("timestamp is %v away from our clock", age)
+	}
+
+	expected := requestSignature(r.Method, r.URL.RequestURI(), timestamp, nonce)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("bad signature")
+	}
+
+	// Only check the nonce once we know the request is genuine, so no one can fill up our map
+	seenNonces.mux.Lock()
+	defer seenNonces.mux.Unlock()
+
+	now := time.Now()
+	for n, expires := range seenNonces.nonces {
+		if now.After(expires) {
+			delete(seenNonces.nonces, n)
+		}
+	}
+	if _, seen := seenNonces.nonces[nonce]; seen {
+		return errors.New("nonce has already been used")
+	}
+	// Anything older than this fails the timestamp check anyway
+	seenNonces.nonces[nonce] = time.Unix(ts, 0).Add(signatureWindow)
+
+	return nil
+}
+
+// Wrap a handler so it only runs for correctly signed requests
+func requireSignature(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := verifyRequest(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%v] Rejected %v %v from %v: %v\n", time.Now(), r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tor only listens for controllers on localhost, see assets/torrc
+const torControlAddress = "127.0.0.1:9051"
+
+// A connection to the Tor control port
+// It only implements the small part of the control protocol we need, see control-spec.txt
+type TorControl struct {
+	conn   net.Conn
+	reader *textproto.Reader
+	// Asynchronous events we read while waiting for the reply to a command
+	events []*TorReply
+}
+
+// A single reply (or asynchronous event) from the control port
+type TorReply struct {
+	Code int
+	// The text of every line in the reply, without the status code
+	Lines []string
+	// The contents of any data blocks ("250+" style lines) in the reply
+	Data []string
+}
+
+func dialTorControl() (*TorControl, error) {
+	conn, err := net.DialTimeout("tcp", torControlAddress, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TorControl{conn: conn, reader: textproto.NewReader(bufio.NewReader(conn))}
+	err = t.authenticate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *TorControl) Close() error {
+	return t.conn.Close()
+}
+
+func (t *TorControl) authenticate() error {
+	reply, err := t.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+
+	// Tor tells us where the cookie lives, so we don't need to hardcode a path that differs between distros
+	re := regexp.MustCompile(`COOKIEFILE="((?:[^"\\]|\\.)*)"`)
+	cookieFile := ""
+	for _, line := range reply.Lines {
+		if matches := re.FindStringSubmatch(line); matches != nil {
+			cookieFile, err = strconv.Unquote(`"` + matches[1] + `"`)
+			if err != nil {
+				return fmt.Errorf("invalid cookie file path from tor: %v", err)
+			}
+		}
+	}
+
+	if cookieFile == "" {
+		// No cookie, so tor is expecting no authentication at all
+		_, err = t.command("AUTHENTICATE")
+		return err
+	}
+
+	cookie, err := ioutil.ReadFile(cookieFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+	return err
+}
+
+// Read a full reply from the control port, including any data blocks
+func (t *TorControl) readReply() (*TorReply, error) {
+	reply := &TorReply{}
+	for {
+		line, err := t.reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed line from control port: %q", line)
+		}
+
+		reply.Code, err = strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed status code from control port: %q", line)
+		}
+		reply.Lines = append(reply.Lines, line[4:])
+
+		switch line[3] {
+		case ' ':
+			// End of the reply
+			return reply, nil
+		case '-':
+			// Another line follows
+		case '+':
+			// A data block follows, terminated by a single dot
+			data, err := t.reader.ReadDotBytes()
+			if err != nil {
+				return nil, err
+			}
+			reply.Data = append(reply.Data, string(data))
+		default:
+			return nil, fmt.Errorf("malformed line from control port: %q", line)
+		}
+	}
+}
+
+// Wait for the reply to a command we've sent, putting any events aside for later
+func (t *TorControl) readCommandReply() (*TorReply, error) {
+	for {
+		reply, err := t.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if reply.Code == 650 {
+			t.events = append(t.events, reply)
+			continue
+		}
+		if reply.Code/100 != 2 {
+			return reply, fmt.Errorf("tor returned %v: %v", reply.Code, strings.Join(reply.Lines, " "))
+		}
+		return reply, nil
+	}
+}
+
+// Send a single line command and wait for the reply
+func (t *TorControl) command(cmd string) (*TorReply, error) {
+	t.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer t.conn.SetDeadline(time.Time{})
+
+	_, err := fmt.Fprintf(t.conn, "%v\r\n", cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.readCommandReply()
+}
+
+// Send a multi line command (such as +HSPOST) with the given data and wait for the reply
+func (t *TorControl) dataCommand(cmd string, data string) (*TorReply, error) {
+	t.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer t.conn.SetDeadline(time.Time{})
+
+	w := bufio.NewWriter(t.conn)
+	tw := textproto.NewWriter(w)
+	err := tw.PrintfLine("%v", cmd)
+	if err != nil {
+		return nil, err
+	}
+	dw := tw.DotWriter()
+	_, err = dw.Write([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	// Closing the DotWriter writes the terminating dot and flushes
+	err = dw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.readCommandReply()
+}
+
+// Wait for an asynchronous event that match returns true for
+func (t *TorControl) waitEvent(match func(*TorReply) bool, timeout time.Duration) (*TorReply, error) {
+	// Check the events we've already received first
+	for i, event := range t.events {
+		if match(event) {
+			t.events = append(t.events[:i], t.events[i+1:]...)
+			return event, nil
+		}
+	}
+	// Nothing queued matched, and we only keep a connection open for a single operation, so they're stale
+	t.events = nil
+
+	t.conn.SetDeadline(time.Now().Add(timeout))
+	defer t.conn.SetDeadline(time.Time{})
+
+	for {
+		reply, err := t.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if reply.Code == 650 && match(reply) {
+			return reply, nil
+		}
+	}
+}
+
+// Fetch a single value with GETINFO
+func (t *TorControl) getInfo(key string) (string, error) {
+	reply, err := t.command("GETINFO " + key)
+	if err != nil {
+		return "", err
+	}
+
+	// Multi line values come back as a data block, everything else as key=value
+	if len(reply.Data) > 0 {
+		return strings.TrimSuffix(reply.Data[0], "\n"), nil
+	}
+	for _, line := range reply.Lines {
+		if strings.HasPrefix(line, key+"=") {
+			return line[len(key)+1:], nil
+		}
+	}
+
+	return "", errors.New("no value for " + key + " in GETINFO reply")
+}
+
+// Fetch the current descriptor for an onion service from the HSDirs
+// address should not include the .onion suffix
+func (t *TorControl) fetchDescriptor(address string) (string, error) {
+	_, err := t.command("SETEVENTS HS_DESC_CONTENT")
+	if err != nil {
+		return "", err
+	}
+	defer t.command("SETEVENTS")
+
+	_, err = t.command("HSFETCH " + address)
+	if err != nil {
+		return "", err
+	}
+
+	// Tor sends an empty descriptor for every HSDir that fails, so keep waiting for a real one
+	event, err := t.waitEvent(func(r *TorReply) bool {
+		return len(r.Data) > 0 && r.Data[0] != "" && strings.HasPrefix(r.Lines[0], "HS_DESC_CONTENT "+address+" ")
+	}, 60*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("no descriptor for %v: %v", address, err)
+	}
+
+	return event.Data[0], nil
+}
+
+// Upload a descriptor to the responsible HSDirs
+func (t *TorControl) postDescriptor(descriptor string) error {
+	_, err := t.dataCommand("+HSPOST", descriptor)
+	return err
+}
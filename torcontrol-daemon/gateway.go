@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often we ask tor how it's doing
+const gatewayCheckInterval = 10 * time.Second
+
+// The health of the tor gateway, as far as the control port tells us
+type GatewayStatus struct {
+	mux sync.Mutex
+	// Bootstrap progress as a percentage, 100 once tor has a consensus and is done
+	Progress int
+	// The last bootstrap summary from tor, useful for working out why we're stuck
+	Summary string
+	// Whether tor believes it can build circuits
+	CircuitEstablished bool
+	// Set if we couldn't talk to tor at all on the last check
+	Error   string
+	Checked time.Time
+}
+
+var gateway GatewayStatus
+
+// Onions only work once tor has bootstrapped and can build circuits
+func (g *GatewayStatus) ready() bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return g.readyLocked()
+}
+
+// As ready, for when the caller already holds the lock
+func (g *GatewayStatus) readyLocked() bool {
+	return g.Error == "" && g.Progress == 100 && g.CircuitEstablished
+}
+
+func (g *GatewayStatus) update(progress int, summary string, circuit bool, err error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.Progress = progress
+	g.Summary = summary
+	g.CircuitEstablished = circuit
+	g.Error = ""
+	if err != nil {
+		g.Error = err.Error()
+	}
+	g.Checked = time.Now()
+}
+
+func gatewayMonitor() {
+	for {
+		progress, summary, circuit, err := checkGateway()
+		wasReady := gateway.ready()
+		gateway.update(progress, summary, circuit, err)
+
+		// Only log changes, otherwise we'd fill the screen every ten seconds
+		if gateway.ready() != wasReady {
+			fmt.Println(fmt.Sprintf("[%v] Gateway ready: %v (progress %v, circuit established %v)", time.Now(), !wasReady, progress, circuit))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error checking tor status: %v\n", err)
+		}
+
+		time.Sleep(gatewayCheckInterval)
+	}
+}
+
+// Ask tor for its bootstrap phase and whether it has a working circuit
+func checkGateway() (progress int, summary string, circuit bool, err error) {
+	tc, err := dialTorControl()
+	if err != nil {
+		return
+	}
+	defer tc.Close()
+
+	// Looks like: NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"
+	phase, err := tc.getInfo("status/bootstrap-phase")
+	if err != nil {
+		return
+	}
+	if matches := regexp.MustCompile(`\bPROGRESS=([0-9]+)\b`).FindStringSubmatch(phase); matches != nil {
+		progress, _ = strconv.Atoi(matches[1])
+	}
+	if matches := regexp.MustCompile(`\bSUMMARY="((?:[^"\\]|\\.)*)"`).FindStringSubmatch(phase); matches != nil {
+		summary = matches[1]
+	}
+
+	established, err := tc.getInfo("status/circuit-established")
+	if err != nil {
+		return
+	}
+	circuit = established == "1"
+
+	return
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	gateway.mux.Lock()
+	status := struct {
+		Ready              bool
+		Progress           int
+		Summary            string
+		CircuitEstablished bool
+		Error              string
+		Checked            time.Time
+	}{
+		gateway.readyLocked(),
+		gateway.Progress,
+		gateway.Summary,
+		gateway.CircuitEstablished,
+		gateway.Error,
+		gateway.Checked,
+	}
+	gateway.mux.Unlock()
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error json encoding gateway status: %v\n", err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balanced onion addresses, in the style of OnionBalance
+//
+// A group is a set of guest VMs that should all answer on a single .onion address. We hold the
+// master key for the group, fetch the descriptors of every guest-N service in it, and publish
+// our own descriptor listing the introduction points of all of them. Clients then get
+// introduced to whichever VM is still up. A group's address is a legacy v2 one, not a v3 one, whatever the guests have.
+//
+// Groups are defined in redis:
+//   balance:groups            - set of group names
+//   balance:<name>:members    - set of VM IDs in the group
+// and we write each group's address back to balance:<name>:address, so operators can read it without going through
+// the signed /balance/ endpoint
+
+// How often to republish every group, descriptors expire and the backends rotate intro points
+const balanceInterval = 15 * time.Minute
+
+// Tor only accepts this many introduction points in a single v2 descriptor
+const maxIntroPoints = 10
+
+// Group names end up in filesystem paths, so keep them boring
+var balanceGroupName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// Only publish one group at a time, each one holds a control port connection for a while
+var balanceLock sync.Mutex
+
+// Republish every group on a timer, or a single group whenever it's sent down the channel
+func balanceLoop(trigger chan string) {
+	ticker := time.NewTicker(balanceInterval)
+	defer ticker.Stop()
+
+	// Publish everything straight away, we have no idea how stale the descriptors are
+	publishAllGroups()
+
+	for {
+		select {
+		case name := <-trigger:
+			err := publishGroup(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error publishing balance group %v: %v\n", name, err)
+			}
+		case <-ticker.C:
+			publishAllGroups()
+		}
+	}
+}
+
+func publishAllGroups() {
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to redis: %v\n", err)
+		return
+	}
+	groups, err := redis.Strings(redisCon.Do("SMEMBERS", "balance:groups"))
+	redisCon.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error fetching balance groups from redis: %v\n", err)
+		return
+	}
+
+	for _, name := range groups {
+		err = publishGroup(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error publishing balance group %v: %v\n", name, err)
+		}
+	}
+}
+
+func publishGroup(name string) error {
+	if !balanceGroupName.MatchString(name) {
+		return errors.New("invalid group name")
+	}
+
+	balanceLock.Lock()
+	defer balanceLock.Unlock()
+
+	key, err := loadBalanceKey(name)
+	if err != nil {
+		return err
+	}
+
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		return err
+	}
+	members, err := redis.Ints(redisCon.Do("SMEMBERS", fmt.Sprintf("balance:%v:members", name)))
+	if err != nil {
+		redisCon.Close()
+		return err
+	}
+
+	// The address only depends on the key, so it's known even if publishing goes wrong
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/var/lib/tor/balance-%v/hostname", name))
+	if err == nil {
+		_, err = redisCon.Do("SET", fmt.Sprintf("balance:%v:address", name), strings.TrimSpace(string(buf)))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error recording the address of balance group %v: %v\n", name, err)
+	}
+	redisCon.Close()
+	if len(members) == 0 {
+		return errors.New("group has no members")
+	}
+
+	tc, err := dialTorControl()
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+
+	// Collect the introduction points of every member that's currently up
+	var memberPoints [][]string
+	for _, vmId := range members {
+		if !validVmId(vmId) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(fmt.Sprintf("/var/lib/tor/guest-%v/hostname", vmId))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "no hostname for balance group %v member %v: %v\n", name, vmId, err)
+			continue
+		}
+		address := strings.TrimSuffix(strings.TrimSpace(string(buf)), ".onion")
+
+		descriptor, err := tc.fetchDescriptor(address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error fetching descriptor for balance group %v member %v: %v\n", name, vmId, err)
+			continue
+		}
+
+		points, err := parseIntroPoints(descriptor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing descriptor for balance group %v member %v: %v\n", name, vmId, err)
+			continue
+		}
+		memberPoints = append(memberPoints, points)
+	}
+
+	// Take intro points from each member in turn so every VM gets a share of the clients
+	var introPoints []string
+	for i := 0; len(introPoints) < maxIntroPoints; i++ {
+		added := false
+		for _, points := range memberPoints {
+			if i < len(points) && len(introPoints) < maxIntroPoints {
+				introPoints = append(introPoints, points[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	if len(introPoints) == 0 {
+		return errors.New("no introduction points available from any member")
+	}
+
+	// Tor publishes two replicas of every descriptor, do the same
+	now := time.Now()
+	for replica := byte(0); replica < 2; replica++ {
+		descriptor, err := buildDescriptor(key, introPoints, replica, now)
+		if err != nil {
+			return err
+		}
+		err = tc.postDescriptor(descriptor)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("[%v] Published balance group %v with %v introduction points from %v members", time.Now(), name, len(introPoints), len(memberPoints)))
+	return nil
+}
+
+// Load the master key for a group, creating one the first time we see the group
+// It's an RSA-1024 key for a legacy v2 onion address, the 16 character kind, as the descriptors we publish are v2 ones;
+// a group can't have a v3 address without publishing v3 descriptors
+// The key is stored in the same format tor uses, so it can be moved to a HiddenServiceDir if need be
+func loadBalanceKey(name string) (*rsa.PrivateKey, error) {
+	dir := fmt.Sprintf("/var/lib/tor/balance-%v", name)
+	keyFile := dir + "/private_key"
+
+	buf, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "RSA PRIVATE KEY" {
+			return nil, errors.New("invalid key in " + keyFile)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// New group, generate a key and hostname for it
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	err = ioutil.WriteFile(keyFile, keyPem, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(dir+"/hostname", []byte(onionAddress(&key.PublicKey)+".onion\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Lower case base32, as used everywhere in onion addresses and descriptor IDs
+func onionBase32(b []byte) string {
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// The permanent ID is the first 80 bits of the SHA1 of the public key
+func permanentId(key *rsa.PublicKey) []byte {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(key))
+	return digest[:10]
+}
+
+// The v2 address for a key, without .onion
+func onionAddress(key *rsa.PublicKey) string {
+	return onionBase32(permanentId(key))
+}
+
+// Pull the individual introduction points out of a v2 descriptor
+func parseIntroPoints(descriptor string) ([]string, error) {
+	const marker = "\nintroduction-points\n"
+	start := strings.Index(descriptor, marker)
+	if start == -1 {
+		return nil, errors.New("descriptor has no introduction points")
+	}
+
+	block, _ := pem.Decode([]byte(descriptor[start+len(marker):]))
+	if block == nil || block.Type != "MESSAGE" {
+		return nil, errors.New("malformed introduction points")
+	}
+
+	var points []string
+	for _, point := range strings.SplitAfter(string(block.Bytes), "\n") {
+		if strings.HasPrefix(point, "introduction-point ") {
+			points = append(points, point)
+		} else if len(points) > 0 {
+			points[len(points)-1] += point
+		}
+	}
+
+	return points, nil
+}
+
+// Build and sign a v2 descriptor for the given replica, see rend-spec.txt section 1.3
+func buildDescriptor(key *rsa.PrivateKey, introPoints []string, replica byte, now time.Time) (string, error) {
+	permId := permanentId(&key.PublicKey)
+
+	// time-period = (current-time + permanent-id-byte * 86400 / 256) / 86400
+	timePeriod := uint32((now.Unix() + int64(permId[0])*86400/256) / 86400)
+
+	// secret-id-part = H(time-period | descriptor-cookie | replica), we never use a cookie
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, timePeriod)
+	h.Write([]byte{replica})
+	secretId := h.Sum(nil)
+
+	// descriptor-id = H(permanent-id | secret-id-part)
+	h = sha1.New()
+	h.Write(permId)
+	h.Write(secretId)
+	descriptorId := h.Sum(nil)
+
+	var desc bytes.Buffer
+	fmt.Fprintf(&desc, "rendezvous-service-descriptor %v\n", onionBase32(descriptorId))
+	desc.WriteString("version 2\n")
+	desc.WriteString("permanent-key\n")
+	pem.Encode(&desc, &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	fmt.Fprintf(&desc, "secret-id-part %v\n", onionBase32(secretId))
+	// Round the publication time like tor does, so it doesn't leak when we last ran
+	fmt.Fprintf(&desc, "publication-time %v\n", now.UTC().Truncate(time.Hour).Format("2006-01-02 15:04:05"))
+	desc.WriteString("protocol-versions 2,3\n")
+	desc.WriteString("introduction-points\n")
+	pem.Encode(&desc, &pem.Block{Type: "MESSAGE", Bytes: []byte(strings.Join(introPoints, ""))})
+	desc.WriteString("signature\n")
+
+	// Tor signs the bare digest, without the PKCS#1 DigestInfo prefix
+	digest := sha1.Sum(desc.Bytes())
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.Hash(0), digest[:])
+	if err != nil {
+		return "", err
+	}
+	pem.Encode(&desc, &pem.Block{Type: "SIGNATURE", Bytes: signature})
+
+	return desc.String(), nil
+}
+
+func balanceHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+	name := r.URL.Path[len("/balance/"):]
+	if !balanceGroupName.MatchString(name) {
+		fmt.Fprintf(w, "invalid")
+		return
+	}
+
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/var/lib/tor/balance-%v/hostname", name))
+	if err != nil {
+		fmt.Fprintf(w, "unknown")
+		return
+	}
+
+	fmt.Fprintf(w, "%s", buf)
+}
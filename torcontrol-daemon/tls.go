@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// We only serve the hypervisor, over mutual TLS with certificates issued by control-ca
+// The role named in the client's certificate is checked as well as the chain, see docs/control-plane-tls.md
+
+// The role in our own certificate
+const ourRole = "torcontrol-daemon"
+
+var tlsCertificate tls.Certificate
+var tlsRoots *x509.CertPool
+
+// Load our certificate and the CA, refusing to run with anything we'd be rejected for later
+func loadTLS() error {
+	caPem, err := ioutil.ReadFile("config/ca.crt")
+	if err != nil {
+		return err
+	}
+	tlsRoots = x509.NewCertPool()
+	if !tlsRoots.AppendCertsFromPEM(caPem) {
+		return errors.New("no certificates found in config/ca.crt")
+	}
+
+	certFile := fmt.Sprintf("config/%v.crt", ourRole)
+	tlsCertificate, err = tls.LoadX509KeyPair(certFile, fmt.Sprintf("config/%v.key", ourRole))
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCertificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if leaf.Subject.CommonName != ourRole {
+		return fmt.Errorf("%v is for role %v, not %v", certFile, leaf.Subject.CommonName, ourRole)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("%v expired on %v, issue a new one with control-ca", certFile, leaf.NotAfter)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: tlsRoots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return fmt.Errorf("%v was not issued by config/ca.crt: %v", certFile, err)
+	}
+
+	return nil
+}
+
+// Check the certificate on the other end of a connection belongs to one of the given roles
+// The chain itself has already been verified against our CA by this point
+func checkPeerRole(state tls.ConnectionState, allowed ...string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+
+	role := state.PeerCertificates[0].Subject.CommonName
+	for _, a := range allowed {
+		if role == a {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("peer certificate is for role %q, expected one of %v", role, allowed)
+}
+
+// TLS configuration for our server, only letting in clients with one of the given roles
+func serverTLSConfig(allowed ...string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    tlsRoots,
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return checkPeerRole(state, allowed...)
+		},
+	}
+}
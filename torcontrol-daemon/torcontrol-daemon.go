@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"io/ioutil"
@@ -30,15 +32,47 @@ type VMInformation struct {
 
 var configLock sync.Mutex
 
+// The VM IDs the hypervisor hands out, the same bounds it checks against
+const minVmId = 50
+const maxVmId = 254
+
+func validVmId(vmId int) bool {
+	return vmId >= minVmId && vmId <= maxVmId
+}
+
+// How long we watch for tor to write a new VM's hostname
+const hostnameWait = 10 * time.Minute
+
 func main() {
 	os.Exit(run())
 }
 
 func run() int {
+	// Only the hypervisor may ask us to do anything, and it proves that with the shared key
+	err := loadControlKey()
+	if err != nil {
+		fmt.Printf("Could not read %v: %v\n", controlKeyFile, err)
+		return 1
+	}
+
+	// The hypervisor only talks to us over mutual TLS, so don't start without a certificate
+	err = loadTLS()
+	if err != nil {
+		fmt.Printf("Could not load TLS configuration: %v\n", err)
+		return 1
+	}
+
 	// Create our datastructures
 	v := sync.Mutex{}
 	configLock = sync.Mutex{}
 
+	// Keep our load balanced onion addresses published
+	balanceTrigger := make(chan string)
+	go balanceLoop(balanceTrigger)
+
+	// Keep track of whether tor is actually usable
+	go gatewayMonitor()
+
 	// Connect here rather than in the handler so that we can ensure we can connect and exit if need be
 	{
 		// Scope our variable to ensure no one accidently uses the connection
@@ -47,30 +81,45 @@ func run() int {
 			fmt.Printf("Could not connect to redis database: %v", err)
 			return 1
 		}
-		go redisPubSubHandle(redisCon)
+		go redisPubSubHandle(redisCon, balanceTrigger)
 		defer redisCon.Close()
 
 	}
 
-	http.HandleFunc("/create/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/create/", requireSignature(func(w http.ResponseWriter, r *http.Request) {
 		createHandler(w, r, v)
-	})
+	}))
+
+	// Undo a create the hypervisor couldn't finish
+	http.HandleFunc("/delete/", requireSignature(deleteHandler))
 
-	http.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/view/", requireSignature(func(w http.ResponseWriter, r *http.Request) {
 		viewHandler(w, r, v)
-	})
+	}))
+
+	// The address of a load balanced group of VMs
+	http.HandleFunc("/balance/", requireSignature(balanceHandler))
+
+	// Whether tor is bootstrapped and able to serve onions
+	http.HandleFunc("/health", requireSignature(healthHandler))
 
 	// IMPORTANT OMG
 	// Only ever bind to one address!
-	http.ListenAndServe("10.0.0.5:80", nil)
+	server := &http.Server{Addr: "10.0.0.5:443", TLSConfig: serverTLSConfig("hypervisor-daemon")}
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		fmt.Printf("Could not start server: %v\n", err)
+		return 1
+	}
 
 	return 0
 }
 
-func redisPubSubHandle(redisCon redis.Conn) {
+func redisPubSubHandle(redisCon redis.Conn, balanceTrigger chan string) {
 	psc := redis.PubSubConn{Conn: redisCon}
 	psc.Subscribe("openport")
 	psc.Subscribe("deletevm")
+	psc.Subscribe("balancegroup")
 
 	for {
 		// TODO Can we use an if/continue instead of a switch?
@@ -88,26 +137,68 @@ func redisPubSubHandle(redisCon redis.Conn) {
 				if err != nil {
 					continue
 				}
-				if vmId < 50 || vmId > 255 {
+				if !validVmId(vmId) {
 					return
 				}
 
-				go deleteVm(vmId)
+				go func(vmId int) {
+					publishDeleted(vmId, deleteVm(vmId))
+				}(vmId)
+			case "balancegroup":
+				// The members of a group changed, republish it rather than waiting for the timer
+				go func(name string) {
+					balanceTrigger <- name
+				}(string(v.Data))
 			}
 		}
 		fmt.Println(fmt.Sprintf("[%v] Got a PUBSUB message", time.Now()))
 	}
 }
 
-func deleteVm(vmId int) {
-	if vmId < 50 || vmId > 255 {
+// Acknowledge a deletevm message on the vmdeleted channel, with the error if we failed
+func publishDeleted(vmId int, deleteErr error) {
+	ack := struct {
+		Id        int
+		Component string
+		Error     string
+	}{Id: vmId, Component: "torcontrol-daemon"}
+	if deleteErr != nil {
+		ack.Error = deleteErr.Error()
+	}
+
+	b, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error json encoding deletion acknowledgement: %v\n", err)
 		return
 	}
 
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to redis: %v\n", err)
+		return
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("PUBLISH", "vmdeleted", b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error publishing deletion acknowledgement: %v\n", err)
+	}
+}
+
+// Clean up after a VM, carrying on past failures so we remove as much as we can
+// Returns the first thing that went wrong
+func deleteVm(vmId int) error {
+	if !validVmId(vmId) {
+		return errors.New("invalid vmId")
+	}
+
+	var firstErr error
+
 	// delete the networking file
 	err := os.Remove(fmt.Sprintf("/etc/network/interfaces.d/vlan%v", vmId))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "could not delete networking interface (vmId: %v): %v", vmId, err)
+		firstErr = fmt.Errorf("deleting networking interface: %v", err)
 	}
 
 	// regenerate configuration
@@ -117,13 +208,21 @@ func deleteVm(vmId int) {
 	err = os.RemoveAll(fmt.Sprintf("/var/lib/tor/guest-%v", vmId))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "could not delete tor datadir (vmId: %v): %v", vmId, err)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("deleting tor datadir: %v", err)
+		}
 	}
 
 	// Finally, remove the extra network device
 	err = exec.Command("ip", "link", "del", fmt.Sprintf("eth0.%v", vmId)).Run()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error remove old eth0.x device", err)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("removing eth0.%v: %v", vmId, err)
+		}
 	}
+
+	return firstErr
 }
 
 func rewriteConfig() {
@@ -234,6 +333,25 @@ func rewriteConfig() {
 
 }
 
+// Remove everything create set up for a VM, for when the hypervisor rolls back a create that failed after us
+// Deleting a VM normally goes through deletevm, so every component hears about it
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+	vmId, err := strconv.Atoi(r.URL.Path[len("/delete/"):])
+	if err != nil || !validVmId(vmId) {
+		fmt.Fprintf(w, "invalid")
+		return
+	}
+
+	err = deleteVm(vmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing vm%v: %v\n", vmId, err)
+		fmt.Fprintf(w, "error")
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
 func viewHandler(w http.ResponseWriter, r *http.Request, v sync.Mutex) {
 	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
 	// Get the ID of the new VM
@@ -245,11 +363,17 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v sync.Mutex) {
 		return
 	}
 
-	if vmId < 50 || vmId > 255 {
+	if !validVmId(vmId) {
 		fmt.Fprintf(w, "invalid")
 		return
 	}
 
+	// Whatever hostname is on disk won't work until tor is bootstrapped
+	if !gateway.ready() {
+		fmt.Fprintf(w, "gateway-not-ready")
+		return
+	}
+
 	// There's a chance it doesn't exist yet, but meh, we can't do much
 	buf, err := ioutil.ReadFile(fmt.Sprintf("/var/lib/tor/guest-%v/hostname", vmId))
 	if err != nil {
@@ -265,6 +389,12 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v sync.Mutex) {
 func createHandler(w http.ResponseWriter, r *http.Request, v sync.Mutex) {
 	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
 	// TODO In the future we will allow more than just sshd port to be a hidden service
+	// Don't accept new VMs while tor can't serve them, the hypervisor will try again
+	if !gateway.ready() {
+		fmt.Fprintf(w, "gateway-not-ready")
+		return
+	}
+
 	// Lock to be safe (unlock in the actual create goroutine)
 	v.Lock()
 
@@ -326,4 +456,36 @@ func create(vmId int, v sync.Mutex) {
 
 	// Now we just create it
 	rewriteConfig()
+
+	// And let the hypervisor know as soon as tor has a hostname for it
+	go announceHostname(vmId)
+}
+
+// Wait for tor to write a new VM's hostname, then publish the VM's ID on onionready
+// The hypervisor polls /view as well, so if we give up or lose redis it only takes longer
+func announceHostname(vmId int) {
+	deadline := time.Now().Add(hostnameWait)
+	for {
+		_, err := os.Stat(fmt.Sprintf("/var/lib/tor/guest-%v/hostname", vmId))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "tor did not write a hostname for vm%v in %v\n", vmId, hostnameWait)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to redis: %v\n", err)
+		return
+	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("PUBLISH", "onionready", vmId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error publishing hostname for vm%v: %v\n", vmId, err)
+	}
 }
@@ -0,0 +1,104 @@
+// A minimal terminal for templates/terminal.html
+// The guest's output is shown as plain text with escape sequences stripped out, which is enough to log in and fix
+// things, and key presses are sent as the bytes a serial terminal would send.
+(function() {
+	"use strict";
+
+	var screen = document.getElementById("terminal");
+	var status = document.getElementById("terminal-status");
+
+	// Keep this much output, so a chatty guest doesn't slow the page down
+	var scrollback = 64 * 1024;
+
+	// Why the hypervisor closed the session, see hypervisor-daemon/terminal.go
+	var reasons = {
+		"idle": "The console was closed because nothing was typed for 10 minutes.",
+		"limit": "The console was closed because it was open for an hour.",
+		"console": "Your VM stopped, or its console went away."
+	};
+
+	// Keys that don't produce a character of their own
+	var keys = {
+		"Enter": "\r",
+		"Backspace": "\x7f",
+		"Tab": "\t",
+		"Escape": "\x1b",
+		"ArrowUp": "\x1b[A",
+		"ArrowDown": "\x1b[B",
+		"ArrowRight": "\x1b[C",
+		"ArrowLeft": "\x1b[D",
+		"Home": "\x1b[H",
+		"End": "\x1b[F",
+		"Delete": "\x1b[3~"
+	};
+
+	var scheme = window.location.protocol === "https:" ? "wss://" : "ws://";
+	var ws = new WebSocket(scheme + window.location.host + "/manage/terminal/attach");
+	ws.binaryType = "arraybuffer";
+	var decoder = new TextDecoder("utf-8");
+
+	// Apply some output to the screen, handling the few control characters that matter for a shell
+	function write(text) {
+		var out = screen.textContent;
+		text = text.replace(/\x1b\[[0-9;?]*[A-Za-z]/g, "").replace(/\x1b[()][0-9A-Za-z]/g, "").replace(/\r\n/g, "\n");
+		for (var i = 0; i < text.length; i++) {
+			var c = text.charAt(i);
+			if (c === "\b") {
+				out = out.slice(0, -1);
+			} else if (c === "\r") {
+				out = out.slice(0, out.lastIndexOf("\n") + 1);
+			} else if (c === "\x07" || c === "\x1b") {
+				continue;
+			} else {
+				out += c;
+			}
+		}
+		if (out.length > scrollback) {
+			out = out.slice(out.length - scrollback);
+		}
+		screen.textContent = out;
+		screen.scrollTop = screen.scrollHeight;
+	}
+
+	ws.onopen = function() {
+		status.textContent = "Connected.";
+		screen.focus();
+	};
+
+	ws.onmessage = function(e) {
+		write(decoder.decode(new Uint8Array(e.data), {stream: true}));
+	};
+
+	ws.onclose = function(e) {
+		status.textContent = reasons[e.reason] || "The console is closed. If someone else had it open, or your VM isn't running, try again later.";
+	};
+
+	screen.addEventListener("keydown", function(e) {
+		if (ws.readyState !== WebSocket.OPEN) {
+			return;
+		}
+
+		var data = null;
+		if (e.ctrlKey && e.key.length === 1 && /[a-z@\[\\\]^_]/i.test(e.key)) {
+			// Ctrl+C and friends
+			data = String.fromCharCode(e.key.toUpperCase().charCodeAt(0) & 0x1f);
+		} else if (keys[e.key] !== undefined) {
+			data = keys[e.key];
+		} else if (e.key.length === 1 && !e.ctrlKey && !e.metaKey) {
+			data = e.key;
+		}
+
+		if (data !== null) {
+			e.preventDefault();
+			ws.send(data);
+		}
+	});
+
+	// Pasting sends the text as if it were typed
+	screen.addEventListener("paste", function(e) {
+		if (ws.readyState === WebSocket.OPEN) {
+			e.preventDefault();
+			ws.send(e.clipboardData.getData("text").replace(/\r?\n/g, "\r"));
+		}
+	});
+})();
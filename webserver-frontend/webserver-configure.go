@@ -38,6 +38,15 @@ func main() {
 		return
 	}
 
+	// Generate the key shared with hypervisor-daemon and torcontrol-daemon for signing requests
+	controlKey := securecookie.GenerateRandomKey(32)
+	err = ioutil.WriteFile("config/control.key", controlKey, 0600)
+	if err != nil {
+		fmt.Printf("Failed to create control.key: %v\r\n", err)
+		return
+	}
+
 	// Configuration complete!
 	fmt.Println("Configuration complete")
+	fmt.Println("Copy config/control.key to the config/ directory of hypervisor-daemon and torcontrol-daemon")
 }
@@ -1,20 +1,28 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"gopkg.in/boj/redistore.v1"
 	"html/template"
 	"io/ioutil"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,19 +33,99 @@ const MAXVMS = 25
 // Our global session store
 var store *redistore.RediStore
 
+// The key shared with the other daemons, used to sign our requests to the hypervisor
+var controlKey []byte
+
+// Our mutual TLS client for the hypervisor, see control-ca for where the certificates come from
+var hypervisorClient *http.Client
+
+// How long a VM lasts without its owner renewing it from /manage, renewing starts it again from then
+const leaseDuration = 7 * 24 * time.Hour
+
+// How close to expiring the manage page starts warning about it
+const leaseWarning = 2 * 24 * time.Hour
+
+// How long after expiring the reaper leaves a VM, so an owner who was away a day can still renew it
+const leaseGrace = 24 * time.Hour
+
+// How often the reaper looks for expired VMs
+const reapInterval = time.Hour
+
+// Every component that has to acknowledge a deletion before the VM ID is free again
+var deleteComponents = []string{"webserver-frontend", "hypervisor-daemon", "torcontrol-daemon"}
+
 // A struct to hold the list of VMs
 type VMList struct {
 	mux sync.Mutex
 	Vms map[int]VMInformation
+	// Acknowledgements for VMs being deleted, component name to error (empty if it succeeded)
+	deleteAcks map[int]map[string]string
 }
 
 type VMInformation struct {
 	URL    string
 	Status string
 	Id     int
+	Plan   string
+	Image  string
+	// booting, healthy or unreachable, from the hypervisor checking port 22, empty if it isn't running
+	Health string
+}
+
+// A plan VMs can be created with, see hypervisor-daemon/assets/plans.json
+type Plan struct {
+	Name string
+	// In MiB
+	Memory int
+	VCPUs  int
+	// In GiB
+	DiskSize      int
+	PortLimit     int
+	SnapshotLimit int
+	Sellable      bool
+}
+
+// A snapshot of a VM's disk
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// A terminal session on a VM's console, as the hypervisor records it
+type TerminalSession struct {
+	Start time.Time
+	End   time.Time
+	// closed, idle, limit or console
+	Ended string
+}
+
+// Something the hypervisor did to a VM, e.g. creating or deleting it, see hypervisor-daemon/jobs.go
+type Job struct {
+	Id   string
+	Kind string
+	// running, done or failed
+	Status   string
+	Steps    []JobStep
+	Error    string
+	Started  time.Time
+	Finished time.Time
 }
 
-func (v *VMList) addVM() (vmId int, err error) {
+type JobStep struct {
+	Name string
+	// pending, running, done or failed
+	Status string
+	Error  string
+}
+
+// A base image VMs can be created from, see hypervisor-daemon/assets/images.json
+// The hypervisor tells us more than this, but these are all we show
+type Image struct {
+	Id   string
+	Name string
+}
+
+func (v *VMList) addVM(plan string, image string) (vmId int, err error) {
 	v.mux.Lock()
 	defer v.mux.Unlock()
 
@@ -56,17 +144,21 @@ func (v *VMList) addVM() (vmId int, err error) {
 	}
 
 	// Instantiate a new VMInformation with the given ID
-	vmInfo := VMInformation{Id: vmId}
+	vmInfo := VMInformation{Id: vmId, Plan: plan, Image: image}
 	v.Vms[vmId] = vmInfo
 
 	return
 }
 
 func (v *VMList) updateVM(vmId int, status string, url string) error {
-	VMInfo := VMInformation{URL: url, Status: status, Id: vmId}
 	v.mux.Lock()
 	defer v.mux.Unlock()
 
+	// Keep the plan and image, the hypervisor's view endpoint doesn't tell us them
+	VMInfo := v.Vms[vmId]
+	VMInfo.URL = url
+	VMInfo.Status = status
+	VMInfo.Id = vmId
 	v.Vms[vmId] = VMInfo
 
 	return nil
@@ -90,6 +182,55 @@ func (v *VMList) removeVM(vmId int) error {
 	return nil
 }
 
+// Mark a VM as being deleted, so it stays out of the free pool until everyone has cleaned up
+func (v *VMList) beginDelete(vmId int) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if v.deleteAcks == nil {
+		v.deleteAcks = make(map[int]map[string]string)
+	}
+	// Start afresh, this may be a retry of a deletion that failed
+	v.deleteAcks[vmId] = make(map[string]string)
+
+	vmInfo := v.Vms[vmId]
+	vmInfo.Id = vmId
+	vmInfo.Status = "deleting"
+	v.Vms[vmId] = vmInfo
+}
+
+// Record a component's acknowledgement of a deletion
+// Once every component has succeeded the VM is removed, if any failed the VM is kept out of the pool as delete-failed
+func (v *VMList) acknowledgeDelete(vmId int, component string, errStr string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	acks, ok := v.deleteAcks[vmId]
+	if !ok {
+		// We never saw the deletevm for this one, someone else is responsible for it
+		return
+	}
+	acks[component] = errStr
+
+	for _, c := range deleteComponents {
+		errStr, acked := acks[c]
+		if !acked {
+			return
+		}
+		if errStr != "" {
+			vmInfo := v.Vms[vmId]
+			vmInfo.Status = "delete-failed"
+			v.Vms[vmId] = vmInfo
+			return
+		}
+	}
+
+	// Everyone is done, it can be reallocated
+	delete(v.deleteAcks, vmId)
+	delete(v.Vms, vmId)
+	fmt.Println(fmt.Sprintf("[%v] VM %v deleted by every component", time.Now(), vmId))
+}
+
 func main() {
 	os.Exit(run())
 }
@@ -114,6 +255,18 @@ func run() int {
 		fmt.Println("Could not read enc.key")
 		return 1
 	}
+	// The hypervisor ignores anything we don't sign
+	controlKey, err = ioutil.ReadFile("config/control.key")
+	if err != nil {
+		fmt.Println("Could not read control.key")
+		return 1
+	}
+	// We only talk to the hypervisor over mutual TLS, never plain HTTP
+	hypervisorClient, err = loadHypervisorClient()
+	if err != nil {
+		fmt.Printf("Could not load TLS configuration: %v\n", err)
+		return 1
+	}
 	store, err = redistore.NewRediStore(10, "tcp", "10.0.5.20:6379", "", authKey, encKey)
 	if err != nil {
 		fmt.Println("Could not start redis session store")
@@ -143,6 +296,9 @@ func run() int {
 		defer redisCon.Close()
 	}
 
+	// Free up the VMs nobody renewed
+	go reapExpired(&v)
+
 	// TODO Template caching
 	// TODO A nicer 404 and 5XX page
 	// These functions repeat a lot, rewrite (globals ftw)
@@ -173,7 +329,7 @@ func run() int {
 	}).Methods("POST")
 
 	r.HandleFunc("/view/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
-		viewHandler(w, r, v)
+		viewHandler(w, r, v, redisCon)
 	})
 
 	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
@@ -184,6 +340,21 @@ func run() int {
 		manageHandler(w, r, v, redisCon)
 	})
 
+	// The end of the VM's serial console, for working out why it didn't come up
+	r.HandleFunc("/manage/console", func(w http.ResponseWriter, r *http.Request) {
+		consoleHandler(w, r)
+	}).Methods("GET")
+
+	// An interactive terminal on the VM's serial console, for when SSH isn't working
+	r.HandleFunc("/manage/terminal", func(w http.ResponseWriter, r *http.Request) {
+		terminalHandler(w, r)
+	}).Methods("GET")
+
+	// The websocket the terminal page talks to, which we relay to the hypervisor
+	r.HandleFunc("/manage/terminal/attach", func(w http.ResponseWriter, r *http.Request) {
+		terminalAttachHandler(w, r)
+	}).Methods("GET")
+
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		indexHandler(w, r, v)
 	})
@@ -195,7 +366,7 @@ func run() int {
 
 func syncWithHypervisor(v *VMList) error {
 	// Get the updated list from the hypervisor daemon
-	resp, err := http.Get("http://10.0.5.20/sync")
+	resp, err := controlGet("https://10.0.5.20/sync")
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (sync) - %v", time.Now(), err))
 		return errors.New("talking to hypervisor-daemon")
@@ -248,6 +419,7 @@ func registerStaticFiles(r *mux.Router) {
 func redisPubSubHandle(redisCon redis.Conn, v *VMList) {
 	psc := redis.PubSubConn{Conn: redisCon}
 	psc.Subscribe("deletevm")
+	psc.Subscribe("vmdeleted")
 
 	for {
 		// TODO Can we use an if/continue instead of a switch?
@@ -265,38 +437,164 @@ func redisPubSubHandle(redisCon redis.Conn, v *VMList) {
 					return
 				}
 
-				go deleteVm(vmId, v)
+				v.beginDelete(vmId)
+				go func(vmId int) {
+					publishDeleted(vmId, deleteVm(vmId))
+				}(vmId)
+			case "vmdeleted":
+				// One of the components (including us) has finished with a deletion
+				var ack struct {
+					Id        int
+					Component string
+					Error     string
+				}
+				err := json.Unmarshal(m.Data, &ack)
+				if err != nil {
+					fmt.Println(fmt.Sprintf("[%v] Invalid deletion acknowledgement - %v", time.Now(), err))
+					continue
+				}
+				if ack.Error != "" {
+					fmt.Println(fmt.Sprintf("[%v] %v failed to delete VM %v - %v", time.Now(), ack.Component, ack.Id, ack.Error))
+				}
+				v.acknowledgeDelete(ack.Id, ack.Component, ack.Error)
 			}
 		}
 		fmt.Println(fmt.Sprintf("[%v] Got a PUBSUB message", time.Now()))
 	}
 }
 
-func deleteVm(vmId int, v *VMList) {
-	if vmId < 50 || vmId > 255 {
+// Acknowledge a deletevm message on the vmdeleted channel, with the error if we failed
+func publishDeleted(vmId int, deleteErr error) {
+	ack := struct {
+		Id        int
+		Component string
+		Error     string
+	}{Id: vmId, Component: "webserver-frontend"}
+	if deleteErr != nil {
+		ack.Error = deleteErr.Error()
+	}
+
+	b, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error json encoding deletion acknowledgement - %v", time.Now(), err))
 		return
 	}
 
 	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error connecting to redis: %v", err)
+		fmt.Println(fmt.Sprintf("[%v] Error connecting to redis (delete) - %v", time.Now(), err))
 		return
 	}
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("PUBLISH", "vmdeleted", b)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error publishing deletion acknowledgement - %v", time.Now(), err))
+	}
+}
+
+func deleteVm(vmId int) error {
+	if vmId < 50 || vmId > 255 {
+		return errors.New("invalid vmId")
+	}
+
+	redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error connecting to redis: %v", err)
+		return err
+	}
+	defer redisCon.Close()
 
-	// delete the hostedposts/password rows
-	redisCon.Do("DEL", fmt.Sprintf("vm:%v:password", vmId))
-	redisCon.Do("DEL", fmt.Sprintf("vm:%v:hostedports", vmId))
+	// delete the hostedposts/password/plan rows
+	_, err = redisCon.Do("DEL", fmt.Sprintf("vm:%v:password", vmId), fmt.Sprintf("vm:%v:hostedports", vmId), fmt.Sprintf("vm:%v:plan", vmId), fmt.Sprintf("vm:%v:consoleaudit", vmId), leaseKey(vmId))
+	if err != nil {
+		return err
+	}
 
 	// Clear out the session entries
 	sessions, err := redis.Strings(redisCon.Do("KEYS", "session_*"))
+	if err != nil {
+		return err
+	}
 	for _, key := range sessions {
 		redisCon.Do("DEL", key)
 	}
 
 	// IT'S JUST A PRANK BRO
 
-	// remove it from our internal object so it can be reallocated
-	v.removeVM(vmId)
+	// We're done, but the ID is only reallocated once the hypervisor and torcontrol are too
+	return nil
+}
+
+func leaseKey(vmId int) string {
+	return fmt.Sprintf("vm:%v:expires", vmId)
+}
+
+// Give a VM a full lease from now, for new VMs and renewals
+func renewLease(vmId int, redisCon redis.Conn) (time.Time, error) {
+	expires := time.Now().Add(leaseDuration)
+	_, err := redisCon.Do("SET", leaseKey(vmId), expires.Unix())
+	return expires, err
+}
+
+// When a VM's lease expires
+// VMs from before leases don't have one, they get a full lease the first time we look
+func fetchLease(vmId int, redisCon redis.Conn) (time.Time, error) {
+	expires, err := redis.Int64(redisCon.Do("GET", leaseKey(vmId)))
+	if err == redis.ErrNil {
+		_, err = redisCon.Do("SET", leaseKey(vmId), time.Now().Add(leaseDuration).Unix(), "NX")
+		if err != nil {
+			return time.Time{}, err
+		}
+		expires, err = redis.Int64(redisCon.Do("GET", leaseKey(vmId)))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(expires, 0), nil
+}
+
+// Every reapInterval, publish deletevm for VMs whose lease ran out more than leaseGrace ago
+// Deleting goes the same way as any other deletion, including our own handler for deletevm
+func reapExpired(v *VMList) {
+	for {
+		time.Sleep(reapInterval)
+
+		// Anything being created or deleted is someone else's business
+		var vmIds []int
+		v.mux.Lock()
+		for vmId, vmInfo := range v.Vms {
+			switch vmInfo.Status {
+			case "", "creating", "deleting", "delete-failed":
+			default:
+				vmIds = append(vmIds, vmId)
+			}
+		}
+		v.mux.Unlock()
+
+		redisCon, err := redis.Dial("tcp", "10.0.5.20:6379")
+		if err != nil {
+			fmt.Println(fmt.Sprintf("[%v] Error connecting to redis (reap) - %v", time.Now(), err))
+			continue
+		}
+		for _, vmId := range vmIds {
+			expires, err := fetchLease(vmId, redisCon)
+			if err != nil {
+				fmt.Println(fmt.Sprintf("[%v] Error fetching lease for VM %v (reap) - %v", time.Now(), vmId, err))
+				continue
+			}
+			if time.Now().Before(expires.Add(leaseGrace)) {
+				continue
+			}
+
+			fmt.Println(fmt.Sprintf("[%v] VM %v's lease expired at %v, deleting it", time.Now(), vmId, expires))
+			_, err = redisCon.Do("PUBLISH", "deletevm", vmId)
+			if err != nil {
+				fmt.Println(fmt.Sprintf("[%v] Error publishing deletevm for VM %v (reap) - %v", time.Now(), vmId, err))
+			}
+		}
+		redisCon.Close()
+	}
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon redis.Conn) {
@@ -456,19 +754,65 @@ func manageHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon re
 		return
 	}
 
+	// The plan they're on decides how many ports they can open
+	plan, err := planForVM(vmId, &v, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error finding plan (manage) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	portLimitReached := false
+	snapshotMessage := ""
+	leaseRenewed := false
+	suspendMessage := ""
+
 	// Do the post action if we need to
-	// Currently, only POST is the stuff to activate the port 80 stuff
+	// Either one of the snapshot forms, or the stuff to activate the port 80 stuff
 	// Check if we need to process the login
 	if r.Method == "POST" {
+		var command string
 		err = r.ParseForm()
-		if err == nil {
-			var command string
-
+		if err == nil && r.FormValue("renewLease") != "" {
+			_, err := renewLease(vmId, redisCon)
+			if err != nil {
+				fmt.Println(fmt.Sprintf("[%v] Error from redis (manage) - %v", time.Now(), err))
+				http.Error(w, "Error", http.StatusInternalServerError)
+				return
+			}
+			leaseRenewed = true
+		} else if err == nil && r.FormValue("suspendAction") != "" {
+			suspendMessage = suspendRequest(vmId, r.FormValue("suspendAction"))
+		} else if err == nil && r.FormValue("snapshotAction") != "" {
+			// The hypervisor checks the name and the plan's limit
+			snapshotMessage = snapshotRequest(vmId, r.FormValue("snapshotAction"), r.FormValue("snapshotName"), plan)
+		} else if err == nil {
 			if _, ok := r.Form["port80"]; ok {
 				command = "SADD"
 			} else {
 				command = "SREM"
 			}
+
+			// Only let them open as many ports as their plan allows, closing one is always fine
+			if command == "SADD" {
+				open, err := redis.Bool(redisCon.Do("SISMEMBER", fmt.Sprintf("vm:%v:hostedports", vmId), "80"))
+				if err != nil {
+					fmt.Println(fmt.Sprintf("[%v] Error from redis (manage) - %v", time.Now(), err))
+					http.Error(w, "Error", http.StatusInternalServerError)
+					return
+				}
+				hosted, err := redis.Int(redisCon.Do("SCARD", fmt.Sprintf("vm:%v:hostedports", vmId)))
+				if err != nil {
+					fmt.Println(fmt.Sprintf("[%v] Error from redis (manage) - %v", time.Now(), err))
+					http.Error(w, "Error", http.StatusInternalServerError)
+					return
+				}
+				if !open && hosted >= plan.PortLimit {
+					portLimitReached = true
+					command = ""
+				}
+			}
+		}
+		if err == nil && command != "" {
 			// Either remove or add the port in the database
 			_, err := redisCon.Do(command, fmt.Sprintf("vm:%v:hostedports", vmId), "80")
 			if err != nil {
@@ -495,6 +839,39 @@ func manageHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon re
 		return
 	}
 
+	// When it'll go, so they can renew it in time
+	expires, err := fetchLease(vmId, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching lease (manage) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Suspending and resuming change the status behind our back, so ask rather than trusting our copy
+	vmInfo, err := fetchVMInformation(vmId)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching VM information (manage) - %v", time.Now(), err))
+		vmInfo = v.Vms[vmId]
+	}
+
+	// A VM that's still being created has no disk to list, so carry on without
+	snapshots, err := fetchSnapshots(vmId)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching snapshots (manage) - %v", time.Now(), err))
+	}
+
+	// So they can see whether anyone has been on their console
+	terminalSessions, err := fetchTerminalSessions(vmId, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching terminal sessions (manage) - %v", time.Now(), err))
+	}
+
+	// So they can see why something they asked for didn't work
+	latestJob, err := fetchLatestJob(vmId, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching latest job (manage) - %v", time.Now(), err))
+	}
+
 	// Render the template
 	t, err := template.ParseFiles("templates/manage.html")
 	if err != nil {
@@ -504,11 +881,37 @@ func manageHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon re
 	}
 
 	templateData := struct {
-		VMInfo     VMInformation
-		Port80Open bool
+		VMInfo           VMInformation
+		Plan             Plan
+		Port80Open       bool
+		PortLimitReached bool
+		Snapshots        []Snapshot
+		SnapshotMessage  string
+		TerminalSessions []TerminalSession
+		LeaseExpires     time.Time
+		LeaseDeletes     time.Time
+		LeaseDays        int
+		LeaseEnding      bool
+		LeaseExpired     bool
+		LeaseRenewed     bool
+		SuspendMessage   string
+		LatestJob        *Job
 	}{
-		v.Vms[vmId],
+		vmInfo,
+		plan,
 		port80,
+		portLimitReached,
+		snapshots,
+		snapshotMessage,
+		terminalSessions,
+		expires,
+		expires.Add(leaseGrace),
+		int(leaseDuration.Hours() / 24),
+		expires.Sub(time.Now()) < leaseWarning,
+		time.Now().After(expires),
+		leaseRenewed,
+		suspendMessage,
+		latestJob,
 	}
 	err = t.Execute(w, templateData)
 
@@ -519,6 +922,261 @@ func manageHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon re
 	}
 }
 
+func consoleHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+
+	session, err := store.Get(r, "torcontrol-session")
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error opening session (console)  - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	if session.Values["vmId"] == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	vmId, err := strconv.Atoi(session.Values["vmId"].(string))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error casting vmid (console)  - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/vm/%v/console/log?kib=64", vmId))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (console) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Println(fmt.Sprintf("[%v] Error reading response from hypervisor-daemon (console) - %v %v", time.Now(), resp.Status, err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Plain text, so nothing the guest prints can turn into HTML
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(body)
+}
+
+func terminalHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+
+	session, err := store.Get(r, "torcontrol-session")
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error opening session (terminal)  - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	if session.Values["vmId"] == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	t, err := template.ParseFiles("templates/terminal.html")
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Could parse template - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	err = t.Execute(w, nil)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Could execute template - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func terminalAttachHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
+
+	session, err := store.Get(r, "torcontrol-session")
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error opening session (terminal-attach)  - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	if session.Values["vmId"] == nil {
+		http.Error(w, "Not logged in", http.StatusForbidden)
+		return
+	}
+
+	vmId, err := strconv.Atoi(session.Values["vmId"].(string))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error casting vmid (terminal-attach)  - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Connect to the hypervisor first, so if the console isn't available the browser gets told why
+	guest, err := dialTerminal(vmId)
+	if err == errTerminalBusy {
+		http.Error(w, "Someone else has the console open", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (terminal-attach) - %v", time.Now(), err))
+		http.Error(w, "The console isn't available, is your VM running?", http.StatusBadGateway)
+		return
+	}
+	defer guest.Close()
+
+	// The default origin check makes sure the page that opened it is one of ours
+	browser, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer browser.Close()
+
+	// Relay messages both ways until either side hangs up, passing on the hypervisor's reason if it gave one
+	done := make(chan struct{}, 2)
+	go relayTerminal(browser, guest, done)
+	go relayTerminal(guest, browser, done)
+	<-done
+}
+
+var errTerminalBusy = errors.New("console is in use")
+
+var terminalUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+/**
+ * Open a terminal session on a VM's console through the hypervisor
+ */
+func dialTerminal(vmId int) (*websocket.Conn, error) {
+	// Signed as a normal request, the websocket handshake is a GET to the same URI
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://10.0.5.20/vm/%v/console/attach?who=owner", vmId), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = signRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  hypervisorClient.Transport.(*http.Transport).TLSClientConfig,
+		HandshakeTimeout: 30 * time.Second,
+	}
+	conn, resp, err := dialer.Dial(fmt.Sprintf("wss://10.0.5.20/vm/%v/console/attach?who=owner", vmId), req.Header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			return nil, errTerminalBusy
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("%v: %v", err, resp.Status)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+/**
+ * Copy messages from one websocket to the other until either fails
+ */
+func relayTerminal(to *websocket.Conn, from *websocket.Conn, done chan struct{}) {
+	defer func() {
+		done <- struct{}{}
+	}()
+
+	for {
+		messageType, msg, err := from.ReadMessage()
+		if err != nil {
+			reason := ""
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				reason = closeErr.Text
+			}
+			to.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(5*time.Second))
+			return
+		}
+		err = to.WriteMessage(messageType, msg)
+		if err != nil {
+			return
+		}
+	}
+}
+
+/**
+ * The most recent terminal sessions on a VM's console, as recorded by the hypervisor
+ */
+func fetchTerminalSessions(vmId int, redisCon redis.Conn) ([]TerminalSession, error) {
+	records, err := redis.Strings(redisCon.Do("LRANGE", fmt.Sprintf("vm:%v:consoleaudit", vmId), 0, 4))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []TerminalSession
+	for _, record := range records {
+		var session TerminalSession
+		err = json.Unmarshal([]byte(record), &session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+/**
+ * What the hypervisor knows about a VM right now, our own copy is only as fresh as the last sync
+ */
+func fetchVMInformation(vmId int) (VMInformation, error) {
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/view/%v?format=json", vmId))
+	if err != nil {
+		return VMInformation{}, err
+	}
+	defer resp.Body.Close()
+
+	var vmInfo VMInformation
+	err = json.NewDecoder(resp.Body).Decode(&vmInfo)
+	if err != nil {
+		return VMInformation{}, err
+	}
+	return vmInfo, nil
+}
+
+/**
+ * The latest job the hypervisor ran on a VM, or nil if there hasn't been one lately
+ */
+func fetchLatestJob(vmId int, redisCon redis.Conn) (*Job, error) {
+	id, err := redis.String(redisCon.Do("GET", fmt.Sprintf("vm:%v:job", vmId)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/jobs/%v", url.PathEscape(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hypervisor said %v", resp.Status)
+	}
+
+	var job Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
 func createGetHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	fmt.Println(fmt.Sprintf("[%v] %v (GET)", time.Now(), r.URL.Path))
 
@@ -545,6 +1203,21 @@ func createGetHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 		return
 	}
 
+	// Only offer the plans we're allowed to sell
+	plans, err := sellablePlans()
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching plans (create-get) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	images, err := fetchImages()
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching images (create-get) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
 	// Render the template
 	t, err := template.ParseFiles("templates/create.html")
 	if err != nil {
@@ -556,9 +1229,13 @@ func createGetHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	templateData := struct {
 		NumberOfVMs  int
 		RandomString string
+		Plans        []Plan
+		Images       []Image
 	}{
 		len(v.Vms),
 		session.Values["randomString"].(string),
+		plans,
+		images,
 	}
 	err = t.Execute(w, templateData)
 	if err != nil {
@@ -606,8 +1283,44 @@ func createPostHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCo
 		return
 	}
 
+	// Check they picked a plan we sell
+	plans, err := sellablePlans()
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching plans (create-post) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	var plan Plan
+	for _, p := range plans {
+		if p.Name == r.FormValue("plan") {
+			plan = p
+		}
+	}
+	if plan.Name == "" {
+		http.Error(w, "Error - invalid plan", http.StatusBadRequest)
+		return
+	}
+
+	// And an image that exists
+	images, err := fetchImages()
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching images (create-post) - %v", time.Now(), err))
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	var image Image
+	for _, i := range images {
+		if i.Id == r.FormValue("image") {
+			image = i
+		}
+	}
+	if image.Id == "" {
+		http.Error(w, "Error - invalid image", http.StatusBadRequest)
+		return
+	}
+
 	// Add it to our internal tracking
-	vmId, err := v.addVM()
+	vmId, err := v.addVM(plan.Name, image.Id)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[%v] Could not execute v.addVM() - %v", time.Now(), err))
 		http.Error(w, "Error", http.StatusInternalServerError)
@@ -615,7 +1328,7 @@ func createPostHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCo
 	}
 
 	// Talk to the hypervisor about creating the new VM
-	resp, err := http.Get(fmt.Sprintf("http://10.0.5.20/create/%v", vmId))
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/create/%v?plan=%v&image=%v", vmId, url.QueryEscape(plan.Name), url.QueryEscape(image.Id)))
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (create) - %v", time.Now(), err))
 		http.Error(w, "Error", http.StatusInternalServerError)
@@ -650,13 +1363,25 @@ func createPostHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCo
 		return
 	}
 
+	// Remember the plan, we need it for the port limit
+	_, err = redisCon.Do("SET", fmt.Sprintf("vm:%v:plan", vmId), plan.Name)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error from redis (create) - %v", time.Now(), err))
+	}
+
+	// The lease starts now, if this fails it'll get one the first time anyone looks
+	_, err = renewLease(vmId, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error from redis (create) - %v", time.Now(), err))
+	}
+
 	// Assume the key is added, yay!
 	// TODO: Do we need to check the response _ above?
 
 	http.Redirect(w, r, fmt.Sprintf("/view/%v", vmId), http.StatusFound)
 }
 
-func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
+func viewHandler(w http.ResponseWriter, r *http.Request, v VMList, redisCon redis.Conn) {
 	fmt.Println(fmt.Sprintf("[%v] %v", time.Now(), r.URL.Path))
 
 	// TODO: Deal with the case where ?error=true, meaning there was a redis error
@@ -675,7 +1400,7 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	}
 
 	// Resync the status of this VM with the hypervisor
-	resp, err := http.Get(fmt.Sprintf("http://10.0.5.20/view/%v", vmId))
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/view/%v", vmId))
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (view) - %v", time.Now(), err))
 		http.Error(w, "Error", http.StatusInternalServerError)
@@ -693,12 +1418,18 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 
 	// Parse the status so we can build the proper representation
 	url := ""
-	if !(status == "creating" || status == "broken" || status == "invalid") {
+	if !(status == "creating" || status == "broken" || status == "invalid" || status == "gateway-not-ready") {
 		url = status
 		status = "complete"
 	}
 	v.updateVM(vmId, status, url)
 
+	// Deletes in particular are only asked for over pubsub, so this is the only place anyone sees how they went
+	latestJob, err := fetchLatestJob(vmId, redisCon)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error fetching latest job (view) - %v", time.Now(), err))
+	}
+
 	// Render the template
 	t, err := template.ParseFiles("templates/view.html")
 	if err != nil {
@@ -706,7 +1437,14 @@ func viewHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 		http.Error(w, "Error", http.StatusInternalServerError)
 		return
 	}
-	err = t.Execute(w, v.Vms[vmId])
+	templateData := struct {
+		VMInformation
+		LatestJob *Job
+	}{
+		v.Vms[vmId],
+		latestJob,
+	}
+	err = t.Execute(w, templateData)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[%v] Could execute template - %v", time.Now(), err))
 		http.Error(w, "Error", http.StatusInternalServerError)
@@ -809,6 +1547,293 @@ func indexHandler(w http.ResponseWriter, r *http.Request, v VMList) {
 	}
 }
 
+/**
+ * Fetch the plans the hypervisor can create VMs with
+ */
+func fetchPlans() ([]Plan, error) {
+	resp, err := controlGet("https://10.0.5.20/plans")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []Plan
+	err = json.Unmarshal(body, &plans)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+/**
+ * Fetch the images the hypervisor can create VMs from
+ */
+func fetchImages() ([]Image, error) {
+	resp, err := controlGet("https://10.0.5.20/images")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	err = json.Unmarshal(body, &images)
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+/**
+ * The plans we're allowed to offer on the create form
+ */
+func sellablePlans() ([]Plan, error) {
+	plans, err := fetchPlans()
+	if err != nil {
+		return nil, err
+	}
+
+	var sellable []Plan
+	for _, p := range plans {
+		if p.Sellable {
+			sellable = append(sellable, p)
+		}
+	}
+	return sellable, nil
+}
+
+/**
+ * The plan a VM was created with
+ * VMs from before plans existed, or whose plan has since been removed, keep the single port they always had
+ */
+func planForVM(vmId int, v *VMList, redisCon redis.Conn) (Plan, error) {
+	name, err := redis.String(redisCon.Do("GET", fmt.Sprintf("vm:%v:plan", vmId)))
+	if err != nil && err != redis.ErrNil {
+		return Plan{}, err
+	}
+	if name == "" {
+		v.mux.Lock()
+		name = v.Vms[vmId].Plan
+		v.mux.Unlock()
+	}
+
+	plans, err := fetchPlans()
+	if err != nil {
+		return Plan{}, err
+	}
+	for _, p := range plans {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Plan{Name: name, PortLimit: 1}, nil
+}
+
+/**
+ * Fetch the snapshots of a VM's disk
+ */
+func fetchSnapshots(vmId int) ([]Snapshot, error) {
+	resp, err := controlGet(fmt.Sprintf("https://10.0.5.20/vm/%v/snapshot", vmId))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hypervisor said %v", strings.TrimSpace(string(body)))
+	}
+
+	var snapshots []Snapshot
+	err = json.Unmarshal(body, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+/**
+ * Create, revert to or delete a snapshot, and return what to tell the owner
+ */
+func snapshotRequest(vmId int, action string, name string, plan Plan) string {
+	resp, err := controlRequest("POST", fmt.Sprintf("https://10.0.5.20/vm/%v/snapshot?action=%v&name=%v", vmId, url.QueryEscape(action), url.QueryEscape(name)))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (snapshot) - %v", time.Now(), err))
+		return "Something went wrong, try again later."
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error reading response from hypervisor-daemon (snapshot) - %v", time.Now(), err))
+		return "Something went wrong, try again later."
+	}
+
+	switch strings.TrimSpace(string(body)) {
+	case "ok":
+		return "Done."
+	case "limit":
+		return fmt.Sprintf("Your plan allows %v snapshot(s), delete one first.", plan.SnapshotLimit)
+	case "exists":
+		return "There's already a snapshot with that name."
+	case "unknown":
+		return "There's no snapshot with that name."
+	case "invalid":
+		return "Snapshot names can only have letters, numbers, - and _, and be at most 32 characters long."
+	case "busy":
+		return "Something else is being done to your VM, try again once it's finished."
+	case "not-ready":
+		return "Your VM can't have snapshots taken or restored right now, e.g. while it's suspended or being created."
+	}
+	fmt.Println(fmt.Sprintf("[%v] Unexpected response from hypervisor-daemon (snapshot) - %v", time.Now(), string(body)))
+	return "Something went wrong, try again later."
+}
+
+/**
+ * Ask the hypervisor to suspend or resume a VM, and say how it went in a way we can show the owner
+ */
+func suspendRequest(vmId int, action string) string {
+	if action != "suspend" && action != "resume" {
+		return "Something went wrong, try again later."
+	}
+	resp, err := controlRequest("POST", fmt.Sprintf("https://10.0.5.20/vm/%v/%v", vmId, action))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error talking to hypervisor-daemon (suspend) - %v", time.Now(), err))
+		return "Something went wrong, try again later."
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[%v] Error reading response from hypervisor-daemon (suspend) - %v", time.Now(), err))
+		return "Something went wrong, try again later."
+	}
+
+	switch strings.TrimSpace(string(body)) {
+	case "suspending":
+		return "Suspending, this takes a minute or so. Refresh to see when it's done."
+	case "resuming":
+		return "Resuming, this takes a minute or so. Refresh to see when it's done."
+	case "busy":
+		return "Something else is already happening to your VM, try again in a minute."
+	case "not-running":
+		return "Your VM isn't running, so there's nothing to suspend."
+	case "not-suspended":
+		return "Your VM isn't suspended."
+	}
+	fmt.Println(fmt.Sprintf("[%v] Unexpected response from hypervisor-daemon (suspend) - %v", time.Now(), string(body)))
+	return "Something went wrong, try again later."
+}
+
+/**
+ * Make a GET request to the hypervisor, signed with our shared key
+ */
+func controlGet(url string) (*http.Response, error) {
+	return controlRequest("GET", url)
+}
+
+/**
+ * Make a request to the hypervisor, signed with our shared key
+ * See hypervisor-daemon/auth.go for how the signature is checked
+ */
+func controlRequest(method string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = signRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return hypervisorClient.Do(req)
+}
+
+/**
+ * Add the signature headers for a request to the hypervisor
+ * The signature covers the method, path and query string, so they can't be changed afterwards
+ * docs/request-signing.md is the canonical format, hypervisor-daemon checks it with its own copy
+ */
+func signRequest(req *http.Request) error {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceStr := hex.EncodeToString(nonce)
+
+	mac := hmac.New(sha256.New, controlKey)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v", req.Method, req.URL.RequestURI(), timestamp, nonceStr)
+
+	req.Header.Set("X-Torhost-Timestamp", timestamp)
+	req.Header.Set("X-Torhost-Nonce", nonceStr)
+	req.Header.Set("X-Torhost-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	return nil
+}
+
+/**
+ * Build a HTTP client that presents our certificate, and only accepts the hypervisor's
+ * The hypervisor's role is in its certificate as a DNS name, so we pin that rather than an IP
+ */
+func loadHypervisorClient() (*http.Client, error) {
+	caPem, err := ioutil.ReadFile("config/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("no certificates found in config/ca.crt")
+	}
+
+	cert, err := tls.LoadX509KeyPair("config/webserver-frontend.crt", "config/webserver-frontend.key")
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if leaf.Subject.CommonName != "webserver-frontend" {
+		return nil, fmt.Errorf("config/webserver-frontend.crt is for role %v", leaf.Subject.CommonName)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("config/webserver-frontend.crt expired on %v, issue a new one with control-ca", leaf.NotAfter)
+	}
+	// Otherwise the hypervisor only tells us on the first request, as a failed handshake
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, fmt.Errorf("config/webserver-frontend.crt was not issued by config/ca.crt: %v", err)
+	}
+
+	return &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      roots,
+				ServerName:   "hypervisor-daemon",
+				MinVersion:   tls.VersionTLS12,
+				VerifyConnection: func(state tls.ConnectionState) error {
+					if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "hypervisor-daemon" {
+						return errors.New("server certificate is not for hypervisor-daemon")
+					}
+					return nil
+				},
+			},
+		},
+	}, nil
+}
+
 /**
  * Generate a random string of a given length with a given alphabet
  * If letters parameter is empty, use a default alphabet of ascii runes